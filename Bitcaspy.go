@@ -2,10 +2,12 @@ package bitcasgo
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"os"
 	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/zerodha/logf"
@@ -13,8 +15,8 @@ import (
 )
 
 const (
-	LOCKFILE   = "bitcaspy.lock"
-	HINTS_FILE = "bitcaspy.hints"
+	LOCKFILE  = "bitcaspy.lock"
+	HINT_FILE = "bitcaspy_%d.hint"
 )
 
 type BitCaspy struct {
@@ -24,10 +26,28 @@ type BitCaspy struct {
 	bufPool sync.Pool
 	opts    *Options
 
-	KeyDir KeyDir                     // Hashmap of keys and location of the value for lookup
+	KeyDir KeyDir                     // Ordered index of keys and location of the value for lookup
 	df     *datafile.DataFile         // Active Data file where put operation is performed
 	stale  map[int]*datafile.DataFile // stale is the hashmap of fileId and datafile which arenot currently active for put operation
 	flockF *os.File                   // Lock for performing file lock
+	stats  map[int]*FileStats         // Live and dead data of every datafile by fileId
+
+	storeID storeID // Id of the store carried by the preamble of every file
+	seq     uint64  // Sequence number of the last record written, guarded by the lock
+
+	snapshots atomic.Int32 // Number of open snapshots of the keydir held by transactions and iterators
+
+	mergeMu   sync.Mutex           // Ensures only one merge runs at a time
+	retiredMu sync.Mutex           // Guards retired
+	retired   []*datafile.DataFile // Merged datafiles waiting for open snapshots to be released
+
+	group    groupCommit    // Durable writes waiting to be committed together
+	recovery RecoveryReport // Check of the last datafile made on open
+
+	ctx    context.Context // Cancelled by Close to stop the background workers and abort merges
+	cancel context.CancelFunc
+	wg     sync.WaitGroup // Background workers
+	closed atomic.Bool    // Set by Close, only changed while holding the lock
 }
 
 func initLogger(debug bool) logf.Logger {
@@ -47,6 +67,9 @@ func Init(cfg ...Config) (*BitCaspy, error) {
 			return nil, fmt.Errorf("applying option failed: %w", err)
 		}
 	}
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
 	var (
 		index  = 0
 		lo     = initLogger(opts.debug)
@@ -54,11 +77,9 @@ func Init(cfg ...Config) (*BitCaspy, error) {
 		stale  = map[int]*datafile.DataFile{}
 	)
 
-	// ensure data dir exists
-	if !exists(opts.dir) {
-		if err := os.MkdirAll(opts.dir, 0o755); err != nil {
-			return nil, fmt.Errorf("error creating data dir %q: %w", opts.dir, err)
-		}
+	// ensure data dir exists and is writable
+	if err := opts.checkDir(); err != nil {
+		return nil, err
 	}
 
 	// load existing data files
@@ -74,7 +95,7 @@ func Init(cfg ...Config) (*BitCaspy, error) {
 			return nil, fmt.Errorf("error getting existing ids for %s: %w", datafiles, err)
 		}
 
-		index = len(ids)
+		index = ids[len(ids)-1] + 1
 
 		// Create a in memory datafile from the existing disk datafile
 		for _, id := range ids {
@@ -104,21 +125,36 @@ func Init(cfg ...Config) (*BitCaspy, error) {
 		}
 	}
 
-	// Create a new active datafile
-	df, err := datafile.New(opts.dir, index)
-	if err != nil {
-		return nil, fmt.Errorf("error creating new datafile: %v", err)
+	// Release the lock and the datafiles if the store can't be opened
+	var df *datafile.DataFile
+	abort := func(err error) (*BitCaspy, error) {
+		if df != nil {
+			df.Close()
+		}
+		for _, df := range stale {
+			df.Close()
+		}
+		if flockF != nil {
+			destroyFLock(flockF)
+		}
+		return nil, err
 	}
 
-	// Create a empty keyDirectory
-	KeyDir := make(KeyDir, 0)
+	// Refuse datafiles of other format versions before anything is written to the store
+	store, err := checkDataFiles(opts.dir, stale, index-1, opts)
+	if err != nil {
+		return abort(err)
+	}
 
-	// Initialize key directory from hint file if it exists
-	hintPath := filepath.Join(opts.dir, HINTS_FILE)
-	if err := KeyDir.Decode(hintPath); err != nil {
-		lo.Error("Failed to decode hint file", "path", hintPath, "error", err)
+	// Create a new active datafile, a read-only store is left without one so
+	// nothing is written to it
+	if !opts.readOnly {
+		if df, err = openDataFile(opts.dir, index, store, opts.checksum); err != nil {
+			return abort(fmt.Errorf("error creating new datafile: %v", err))
+		}
 	}
 
+	ctx, cancel := context.WithCancel(context.Background())
 	BitCaspy := &BitCaspy{
 		lo: lo,
 		bufPool: sync.Pool{New: func() any {
@@ -126,43 +162,84 @@ func Init(cfg ...Config) (*BitCaspy, error) {
 		}},
 		opts: opts,
 
-		KeyDir: KeyDir,
-		df:     df,
-		stale:  stale,
-		flockF: flockF,
+		df:      df,
+		stale:   stale,
+		flockF:  flockF,
+		storeID: store,
+		ctx:     ctx,
+		cancel: cancel,
+	}
+
+	// The datafile which was active last may end in a torn write
+	if last, ok := stale[index-1]; ok {
+		if err := BitCaspy.recoverTail(last); err != nil {
+			cancel()
+			return abort(err)
+		}
+	}
+
+	// Initialize key directory from the hint files and datafiles
+	if err := BitCaspy.loadKeyDir(); err != nil {
+		cancel()
+		return abort(fmt.Errorf("error loading keydir: %w", err))
 	}
 
-	// background workers
+	// background workers, stopped by Close
 	if !BitCaspy.opts.readOnly {
+		BitCaspy.wg.Add(2)
 		go BitCaspy.runCompaction(BitCaspy.opts.compactInterval)
 		go BitCaspy.checkFileSize(BitCaspy.opts.checkFileSizeInterval)
 	}
-	if BitCaspy.opts.syncInterval != nil && !BitCaspy.opts.alwaysFSync {
-		interval := *BitCaspy.opts.syncInterval
-		go func() {
-			t := time.NewTicker(interval)
-			defer t.Stop()
-			for range t.C {
-				_ = BitCaspy.Sync()
-			}
-		}()
+	if BitCaspy.opts.durability == SyncInterval && !BitCaspy.opts.readOnly {
+		BitCaspy.wg.Add(1)
+		go BitCaspy.runSync(BitCaspy.opts.syncInterval)
 	}
 
 	return BitCaspy, nil
 }
 
+// Close stops the background workers, aborts any merge in progress and waits for
+// them to return before writing the hint files and closing the datafiles.
+// Every method returns ErrClosed once the database is closed.
 func (b *BitCaspy) Close() error {
+	b.cancel()
+	b.wg.Wait()
+
+	// Merges started with Merge or CompactRange abort once the context is cancelled
+	b.mergeMu.Lock()
+	defer b.mergeMu.Unlock()
+
 	b.Lock()
 	defer b.Unlock()
+	if b.closed.Load() {
+		return ErrClosed
+	}
+	b.closed.Store(true)
 
-	// Generate Hint files from the keydir
-	if err := b.genrateHintFiles(); err != nil {
-		b.lo.Error("Error generating Hint files from keydir", "error", err)
+	// Generate Hint files for the datafiles, the active one becomes immutable once closed
+	if !b.opts.readOnly {
+		for id, df := range b.stale {
+			if exists(b.hintPath(id)) {
+				continue
+			}
+			if err := b.writeHintFile(df); err != nil {
+				b.lo.Error("Error generating hint file", "id", id, "error", err)
+			}
+		}
+		// The hint file skips the check of the datafile on the next open, so its
+		// records have to be on disk first
+		if err := b.df.Sync(); err != nil {
+			b.lo.Error("Error syncing active data file", "error", err)
+		} else if err := b.writeHintFile(b.df); err != nil {
+			b.lo.Error("Error generating hint file for active data file", "error", err)
+		}
 	}
 
 	// Close the active data file
-	if err := b.df.Close(); err != nil {
-		b.lo.Error("Error closing active data file", "error", err)
+	if b.df != nil {
+		if err := b.df.Close(); err != nil {
+			b.lo.Error("Error closing active data file", "error", err)
+		}
 	}
 
 	// Close all the stale data files
@@ -171,6 +248,22 @@ func (b *BitCaspy) Close() error {
 			b.lo.Error("Error closing stale data file", "error", err)
 		}
 	}
+
+	// Merged datafiles kept around for open snapshots are no longer needed.
+	// Once one can't be removed the newer ones are kept as well, they may hold
+	// the tombstones of its records.
+	b.retiredMu.Lock()
+	for len(b.retired) > 0 {
+		if err := b.removeNextRetired(); err != nil {
+			b.lo.Error("Error removing merged data file", "error", err)
+			break
+		}
+	}
+	for _, df := range b.retired {
+		df.Close()
+	}
+	b.retired = nil
+	b.retiredMu.Unlock()
 	if b.flockF != nil {
 		if err := destroyFLock(b.flockF); err != nil {
 			b.lo.Error("Error releasing file lock", "error", err)
@@ -179,86 +272,258 @@ func (b *BitCaspy) Close() error {
 	return nil
 }
 
+// StoreID returns the id of the store, a UUID generated when its first datafile was created.
+func (b *BitCaspy) StoreID() string {
+	return b.storeID.String()
+}
+
 // Gets the key from the keydir and then checks for the key in the keydir hashmap
 // Then it goes to the value offset in the data file
 func (b *BitCaspy) Get(key string) ([]byte, error) {
-	b.RLock()
-	defer b.RUnlock()
-	record, err := b.get(key)
-	if err != nil {
+	return b.GetContext(context.Background(), key)
+}
+
+// GetContext is like Get but gives up once the context is done while waiting for the lock.
+func (b *BitCaspy) GetContext(ctx context.Context, key string) ([]byte, error) {
+	if err := b.rLockContext(ctx); err != nil {
 		return nil, err
 	}
-	if record.isExpired() {
-		return nil, ErrExpiredKey
+	defer b.RUnlock()
+	if b.closed.Load() {
+		return nil, ErrClosed
 	}
-	if !record.isValidChecksum() {
-		return nil, ErrChecksumMismatch
+	record, err := b.getValid(key)
+	if err != nil {
+		return nil, err
 	}
 	return record.Value, nil
 }
 
 // puts the key into the active data file and puts the key and inserts in the keyDir hashmap the fileId, vsize and offset at the data file
 func (b *BitCaspy) Put(key string, value []byte) error {
+	return b.PutContext(context.Background(), key, value)
+}
+
+// PutContext is like Put but gives up once the context is done while waiting for
+// the lock. The put completes regardless of the context once the record is written.
+func (b *BitCaspy) PutContext(ctx context.Context, key string, value []byte) error {
+	return b.PutWithOptions(ctx, key, value, WriteOptions{})
+}
+
+// PutWithOptions is like PutContext with the write adjusted by the options.
+func (b *BitCaspy) PutWithOptions(ctx context.Context, key string, value []byte, opts WriteOptions) error {
 	if b.opts.readOnly {
 		return ErrReadOnly
 	}
-	if key == "" {
-		return ErrEmptyKey
+	if err := validateEntry(key, value); err != nil {
+		return err
 	}
-	if uint64(len(key)) > uint64(^uint32(0)) {
-		return ErrLargeKey
+	if b.groupCommits(opts) {
+		return b.commitDurable(ctx, batchOp{key: key, value: value}, nil)
 	}
-	if uint64(len(value)) > uint64(^uint32(0)) {
-		return ErrLargeValue
+	if err := b.lockContext(ctx); err != nil {
+		return err
 	}
-	b.Lock()
 	defer b.Unlock()
-	return b.put(b.df, key, value, nil)
+	if b.closed.Load() {
+		return ErrClosed
+	}
+	return b.put(key, value, nil)
 }
 
-func (b *BitCaspy) Delete(key string) error {
+// PutWithTTL puts the key like Put and expires it once the ttl has elapsed.
+func (b *BitCaspy) PutWithTTL(key string, value []byte, ttl time.Duration) error {
+	if b.opts.readOnly {
+		return ErrReadOnly
+	}
+	if err := validateEntry(key, value); err != nil {
+		return err
+	}
+	if ttl <= 0 {
+		return ErrInvalidTTL
+	}
+	expiry := time.Now().Add(ttl)
+	if b.groupCommits(WriteOptions{}) {
+		return b.commitDurable(context.Background(), batchOp{key: key, value: value}, &expiry)
+	}
 	b.Lock()
 	defer b.Unlock()
+	if b.closed.Load() {
+		return ErrClosed
+	}
+	return b.put(key, value, &expiry)
+}
+
+// Expire sets an existing key to expire once the ttl has elapsed, replacing any previous expiry.
+func (b *BitCaspy) Expire(key string, ttl time.Duration) error {
 	if b.opts.readOnly {
 		return ErrReadOnly
 	}
-	return b.delete(key)
+	if ttl <= 0 {
+		return ErrInvalidTTL
+	}
+	b.Lock()
+	defer b.Unlock()
+	if b.closed.Load() {
+		return ErrClosed
+	}
+	record, err := b.getValid(key)
+	if err != nil {
+		return err
+	}
+	expiry := time.Now().Add(ttl)
+	return b.put(key, record.Value, &expiry)
 }
 
-func (b *BitCaspy) list_keys() []string {
+// TTL returns the remaining lifetime of the key. Keys without an expiry return zero.
+func (b *BitCaspy) TTL(key string) (time.Duration, error) {
 	b.RLock()
-	keys := make([]string, 0, len(b.KeyDir))
-	for key := range b.KeyDir {
-		keys = append(keys, key)
+	defer b.RUnlock()
+	if b.closed.Load() {
+		return 0, ErrClosed
+	}
+	record, err := b.getValid(key)
+	if err != nil {
+		return 0, err
 	}
-	b.RUnlock()
-	return keys
+	if record.Header.Expiry == 0 {
+		return 0, nil
+	}
+	return time.Until(record.expiresAt()), nil
 }
 
-func (b *BitCaspy) Fold(foldingFunc func(key string, value []byte, acc string) error) error {
-	// take a snapshot of keys under read lock
-	b.RLock()
-	keys := make([]string, 0, len(b.KeyDir))
-	for key := range b.KeyDir {
-		keys = append(keys, key)
+// Persist removes the expiry of the key so that it lives until it's deleted.
+func (b *BitCaspy) Persist(key string) error {
+	if b.opts.readOnly {
+		return ErrReadOnly
 	}
-	b.RUnlock()
+	b.Lock()
+	defer b.Unlock()
+	if b.closed.Load() {
+		return ErrClosed
+	}
+	record, err := b.getValid(key)
+	if err != nil {
+		return err
+	}
+	if record.Header.Expiry == 0 {
+		return nil
+	}
+	return b.put(key, record.Value, nil)
+}
 
-	for _, key := range keys {
-		val, err := b.Get(key)
-		if err != nil {
-			return err
-		}
-		if err := foldingFunc(key, val, ""); err != nil {
-			return err
+func (b *BitCaspy) Delete(key string) error {
+	return b.DeleteContext(context.Background(), key)
+}
+
+// DeleteContext is like Delete but gives up once the context is done while waiting for the lock.
+func (b *BitCaspy) DeleteContext(ctx context.Context, key string) error {
+	return b.DeleteWithOptions(ctx, key, WriteOptions{})
+}
+
+// DeleteWithOptions is like DeleteContext with the write adjusted by the options.
+func (b *BitCaspy) DeleteWithOptions(ctx context.Context, key string, opts WriteOptions) error {
+	if b.groupCommits(opts) && !b.opts.readOnly {
+		return b.commitDurable(ctx, batchOp{key: key, delete: true}, nil)
+	}
+	if err := b.lockContext(ctx); err != nil {
+		return err
+	}
+	defer b.Unlock()
+	if b.closed.Load() {
+		return ErrClosed
+	}
+	if b.opts.readOnly {
+		return ErrReadOnly
+	}
+	return b.delete(key)
+}
+
+// runSync syncs the active datafile at every interval until the database is closed.
+func (b *BitCaspy) runSync(interval time.Duration) {
+	defer b.wg.Done()
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-b.ctx.Done():
+			return
+		case <-t.C:
+			if err := b.Sync(); err != nil {
+				b.lo.Error("Error syncing active data file", "error", err)
+			}
 		}
 	}
-	return nil
 }
 
 func (b *BitCaspy) Sync() error {
-	b.Lock()
-	defer b.Unlock()
+	return b.SyncContext(context.Background())
+}
 
-	return b.df.Sync()
+// SyncContext flushes the active datafile to disk, giving up once the context is done.
+// A flush which already started can't be interrupted, it carries on in the background
+// and holds the lock until it's done.
+func (b *BitCaspy) SyncContext(ctx context.Context) error {
+	if err := b.lockContext(ctx); err != nil {
+		return err
+	}
+	if b.closed.Load() {
+		b.Unlock()
+		return ErrClosed
+	}
+	// A read-only store has no active datafile to flush
+	if b.df == nil {
+		b.Unlock()
+		return nil
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		defer b.Unlock()
+		done <- b.df.Sync()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// lockContext acquires the write lock unless the context is done first.
+func (b *BitCaspy) lockContext(ctx context.Context) error {
+	return acquireContext(ctx, b.TryLock, b.Lock, b.Unlock)
+}
+
+// rLockContext acquires the read lock unless the context is done first.
+func (b *BitCaspy) rLockContext(ctx context.Context) error {
+	return acquireContext(ctx, b.TryRLock, b.RLock, b.RUnlock)
+}
+
+// acquireContext waits for a lock in the background so that the wait can be abandoned
+// once the context is done. An abandoned lock is released as soon as it's acquired.
+func acquireContext(ctx context.Context, tryLock func() bool, lock, unlock func()) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if tryLock() {
+		return nil
+	}
+
+	locked := make(chan struct{})
+	go func() {
+		lock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		return nil
+	case <-ctx.Done():
+		go func() {
+			<-locked
+			unlock()
+		}()
+		return ctx.Err()
+	}
 }
@@ -10,11 +10,11 @@ import (
 func getFLock(flockfile string) (*os.File, error) {
 	flockF, err := os.Create(flockfile)
 	if err != nil {
-		return nil, fmt.Errorf("cannot create lock file %q: %w", flockF, err)
+		return nil, fmt.Errorf("cannot create lock file %q: %w", flockfile, err)
 	}
 
 	if err := unix.Flock(int(flockF.Fd()), unix.LOCK_EX|unix.LOCK_NB); err != nil {
-		return nil, fmt.Errorf("cannot acquire lock on file %q: %w", flockF, err)
+		return nil, fmt.Errorf("cannot acquire lock on file %q: %w", flockfile, err)
 	}
 
 	return flockF, nil
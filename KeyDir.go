@@ -1,55 +1,240 @@
 package bitcasgo
 
-import (
-	"encoding/gob"
-	"os"
-)
+import "hash/fnv"
 
-type KeyDir map[string]Meta
+// KeyDir maps every live key to the location of its latest record.
+// Implementations keep the keys ordered so they can be scanned by range or prefix.
+// A KeyDir is not safe for concurrent use, the database guards it with its lock.
+type KeyDir interface {
+	// Get returns the meta of the key and whether the key exists.
+	Get(key string) (Meta, bool)
+	// Put sets the meta of the key.
+	Put(key string, meta Meta)
+	// Delete removes the key.
+	Delete(key string)
+	// Len returns the number of keys.
+	Len() int
+	// Range calls fn for every key in [start, end) in ascending order, or in
+	// descending order when reverse is set. An empty end has no upper bound.
+	// Iteration stops as soon as fn returns false.
+	Range(start, end string, reverse bool, fn func(key string, meta Meta) bool)
+	// Scan calls fn for every key with the prefix, in the same manner as Range.
+	Scan(prefix string, reverse bool, fn func(key string, meta Meta) bool)
+	// Snapshot returns a copy of the keydir which is unaffected by later changes to either of them.
+	Snapshot() KeyDir
+}
 
 // Meta is stored as value in keyDir and keys are the keys in the database
 type Meta struct {
 	fileId     int
 	RecordSize int
-	RecordPos  int
-	tstamp     int
+	RecordPos  int64  // Offset of the end of the record in its datafile
+	tstamp     int64  // Unix time in nanoseconds the record was written at
+	seq        uint64 // Sequence number of the record
+}
+
+// NewKeyDir returns the default keydir. Keys are held in a persistent treap which
+// keeps them ordered and makes snapshots free, along with a hashmap for point lookups.
+func NewKeyDir() KeyDir {
+	return &treeKeyDir{keys: make(map[string]Meta)}
 }
 
-func (k *KeyDir) Encode(fPath string) error {
-	file, err := os.Create(fPath)
-	if err != nil {
-		return err
+type treeKeyDir struct {
+	root *treapNode
+	size int
+	keys map[string]Meta // Hashmap for point lookups, nil for snapshots
+}
+
+func (t *treeKeyDir) Get(key string) (Meta, bool) {
+	if t.keys != nil {
+		meta, ok := t.keys[key]
+		return meta, ok
+	}
+	return t.root.get(key)
+}
+
+func (t *treeKeyDir) Put(key string, meta Meta) {
+	if _, ok := t.Get(key); !ok {
+		t.size++
+	}
+	if t.keys != nil {
+		t.keys[key] = meta
+	}
+	t.root = t.root.insert(key, meta, priority(key))
+}
+
+func (t *treeKeyDir) Delete(key string) {
+	if _, ok := t.Get(key); !ok {
+		return
+	}
+	t.size--
+	if t.keys != nil {
+		delete(t.keys, key)
 	}
-	defer file.Close()
+	t.root = t.root.remove(key)
+}
 
-	encoder := gob.NewEncoder(file)
+func (t *treeKeyDir) Len() int {
+	return t.size
+}
 
-	if err := encoder.Encode(k); err != nil {
-		return err
+// Range walks the tree as it was when called, so fn is free to modify the keydir.
+func (t *treeKeyDir) Range(start, end string, reverse bool, fn func(key string, meta Meta) bool) {
+	if reverse {
+		t.root.descend(start, end, fn)
+		return
 	}
+	t.root.ascend(start, end, fn)
+}
+
+func (t *treeKeyDir) Scan(prefix string, reverse bool, fn func(key string, meta Meta) bool) {
+	t.Range(prefix, prefixEnd(prefix), reverse, fn)
+}
+
+// Snapshot shares the nodes of the tree, which are never modified in place.
+// Point lookups on the snapshot go through the tree instead of the hashmap.
+func (t *treeKeyDir) Snapshot() KeyDir {
+	return &treeKeyDir{root: t.root, size: t.size}
+}
 
-	return nil
+// treapNode is a node of a persistent treap. Nodes are copied on every change
+// instead of being modified, so older roots remain valid snapshots.
+type treapNode struct {
+	key         string
+	meta        Meta
+	priority    uint32
+	left, right *treapNode
 }
 
-func (k *KeyDir) Decode(fPath string) error {
-	file, err := os.Open(fPath)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return nil
+// priority derives the heap priority of a key from its hash.
+func priority(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return h.Sum32()
+}
+
+func (n *treapNode) get(key string) (Meta, bool) {
+	for n != nil {
+		switch {
+		case key < n.key:
+			n = n.left
+		case key > n.key:
+			n = n.right
+		default:
+			return n.meta, true
 		}
-		return err
 	}
-	defer file.Close()
+	return Meta{}, false
+}
 
-	decoder := gob.NewDecoder(file)
+// insert returns the root of a new tree holding the key. Nodes returned by the
+// recursive call are fresh copies, so they can be rotated in place.
+func (n *treapNode) insert(key string, meta Meta, prio uint32) *treapNode {
+	if n == nil {
+		return &treapNode{key: key, meta: meta, priority: prio}
+	}
 
-	// Create a new map to decode into
-	newKeyDir := make(KeyDir)
-	if err := decoder.Decode(&newKeyDir); err != nil {
-		return err
+	c := *n
+	switch {
+	case key < n.key:
+		c.left = n.left.insert(key, meta, prio)
+		if c.left.priority > c.priority {
+			l := c.left
+			c.left, l.right = l.right, &c
+			return l
+		}
+	case key > n.key:
+		c.right = n.right.insert(key, meta, prio)
+		if c.right.priority > c.priority {
+			r := c.right
+			c.right, r.left = r.left, &c
+			return r
+		}
+	default:
+		c.meta = meta
+	}
+	return &c
+}
+
+// remove returns the root of a new tree without the key.
+func (n *treapNode) remove(key string) *treapNode {
+	if n == nil {
+		return nil
 	}
 
-	// Replace the current keydir with the decoded one
-	*k = newKeyDir
-	return nil
+	switch {
+	case key < n.key:
+		c := *n
+		c.left = n.left.remove(key)
+		return &c
+	case key > n.key:
+		c := *n
+		c.right = n.right.remove(key)
+		return &c
+	default:
+		return joinTreaps(n.left, n.right)
+	}
+}
+
+// joinTreaps joins two trees where every key of a is smaller than the keys of b.
+func joinTreaps(a, b *treapNode) *treapNode {
+	if a == nil {
+		return b
+	}
+	if b == nil {
+		return a
+	}
+	if a.priority > b.priority {
+		c := *a
+		c.right = joinTreaps(a.right, b)
+		return &c
+	}
+	c := *b
+	c.left = joinTreaps(a, b.left)
+	return &c
+}
+
+func (n *treapNode) ascend(start, end string, fn func(key string, meta Meta) bool) bool {
+	if n == nil {
+		return true
+	}
+	if start < n.key && !n.left.ascend(start, end, fn) {
+		return false
+	}
+	if end != "" && n.key >= end {
+		return true
+	}
+	if n.key >= start && !fn(n.key, n.meta) {
+		return false
+	}
+	return n.right.ascend(start, end, fn)
+}
+
+func (n *treapNode) descend(start, end string, fn func(key string, meta Meta) bool) bool {
+	if n == nil {
+		return true
+	}
+	if (end == "" || n.key < end) && !n.right.descend(start, end, fn) {
+		return false
+	}
+	if n.key < start {
+		return true
+	}
+	if (end == "" || n.key < end) && !fn(n.key, n.meta) {
+		return false
+	}
+	return n.left.descend(start, end, fn)
+}
+
+// prefixEnd returns the smallest key greater than every key with the prefix,
+// or an empty string when there is no such key.
+func prefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return ""
 }
@@ -0,0 +1,151 @@
+package bitcasgo
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+)
+
+// Batch collects puts and deletes which are applied atomically on Commit.
+// All the records of a batch are appended to the active datafile in a single
+// write surrounded by begin and commit markers, and recovery ignores any batch
+// whose commit marker is missing. A Batch is not safe for concurrent use.
+type Batch struct {
+	b   *BitCaspy
+	ops []batchOp
+}
+
+type batchOp struct {
+	key    string
+	value  []byte
+	delete bool
+}
+
+// NewBatch returns an empty batch for the database.
+func (b *BitCaspy) NewBatch() *Batch {
+	return &Batch{b: b}
+}
+
+// Put queues the key and value to be written when the batch is committed.
+func (bt *Batch) Put(key string, value []byte) error {
+	if err := validateEntry(key, value); err != nil {
+		return err
+	}
+	bt.ops = append(bt.ops, batchOp{key: key, value: value})
+	return nil
+}
+
+// Delete queues the deletion of the key when the batch is committed.
+func (bt *Batch) Delete(key string) error {
+	if key == "" {
+		return ErrEmptyKey
+	}
+	bt.ops = append(bt.ops, batchOp{key: key, delete: true})
+	return nil
+}
+
+// Len returns the number of operations queued in the batch.
+func (bt *Batch) Len() int {
+	return len(bt.ops)
+}
+
+// Discard drops every queued operation. The batch can be reused afterwards.
+func (bt *Batch) Discard() {
+	bt.ops = bt.ops[:0]
+}
+
+// Commit writes every queued operation to the active datafile under a single lock
+// and syncs it to disk once. Either all the operations become visible or none do.
+// The batch is emptied once it's committed and can be reused.
+func (bt *Batch) Commit() error {
+	return bt.CommitContext(context.Background())
+}
+
+// CommitContext is like Commit but gives up once the context is done while waiting
+// for the lock. Once the batch is being written it's committed regardless of the context.
+func (bt *Batch) CommitContext(ctx context.Context) error {
+	b := bt.b
+	if b.opts.readOnly {
+		return ErrReadOnly
+	}
+	if len(bt.ops) == 0 {
+		return nil
+	}
+
+	if err := b.lockContext(ctx); err != nil {
+		return err
+	}
+	defer b.Unlock()
+	if b.closed.Load() {
+		return ErrClosed
+	}
+	if err := b.commitBatch(bt.ops); err != nil {
+		return err
+	}
+
+	bt.ops = bt.ops[:0]
+	return nil
+}
+
+// commitBatch appends the operations to the active datafile between batch markers,
+// syncs it and applies them to the keydir. The caller must hold the write lock.
+func (b *BitCaspy) commitBatch(ops []batchOp) error {
+	buf := b.bufPool.Get().(*bytes.Buffer)
+	defer b.bufPool.Put(buf)
+	defer buf.Reset()
+
+	begin := newControlRecord(flagBatchBegin, len(ops))
+	encodeRecord(buf, b.opts.checksum, begin.Header, "", begin.Value)
+
+	// Location of every record within the buffer
+	metas := make([]Meta, len(ops))
+	for i, op := range ops {
+		header, value := b.newTombstoneHeader(op.key), op.value
+		if !op.delete {
+			var (
+				flags byte
+				err   error
+			)
+			if value, flags, err = b.opts.compressValue(op.value); err != nil {
+				return err
+			}
+			header = b.newHeader(op.key, value, flags, nil)
+		}
+		start := buf.Len()
+		encodeRecord(buf, b.opts.checksum, header, op.key, value)
+		metas[i] = Meta{
+			RecordSize: buf.Len() - start,
+			RecordPos:  int64(buf.Len()),
+			tstamp:     header.Tstamp,
+			seq:        header.Seq,
+		}
+	}
+
+	commit := newControlRecord(flagBatchCommit, len(ops))
+	encodeRecord(buf, b.opts.checksum, commit.Header, "", commit.Value)
+
+	// A batch is only recovered from a single datafile, so it has to fit in one
+	if err := b.makeRoom(buf.Len()); err != nil {
+		return err
+	}
+	offset, err := b.df.Write(buf.Bytes())
+	if err != nil {
+		return fmt.Errorf("Error writing the batch to the data file: %v", err)
+	}
+	if err := b.df.Sync(); err != nil {
+		return fmt.Errorf("Error syncing the batch to the disk: %v", err)
+	}
+
+	// The batch is durable, so apply it to the keydir
+	for i, op := range ops {
+		meta := metas[i]
+		meta.fileId = b.df.ID()
+		meta.RecordPos += offset
+		if op.delete {
+			b.removeKey(op.key, meta)
+			continue
+		}
+		b.setKey(op.key, meta)
+	}
+	return nil
+}
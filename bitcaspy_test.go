@@ -0,0 +1,300 @@
+package bitcasgo
+
+import (
+	"context"
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// openTest opens a database in a fresh temporary directory, closing it once the test is done.
+func openTest(t *testing.T, cfg ...Config) (*BitCaspy, string) {
+	t.Helper()
+	dir := t.TempDir()
+	return reopenTest(t, dir, cfg...), dir
+}
+
+// reopenTest opens the database in dir, closing it once the test is done.
+func reopenTest(t *testing.T, dir string, cfg ...Config) *BitCaspy {
+	t.Helper()
+	b, err := Init(append([]Config{WithDir(dir)}, cfg...)...)
+	if err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := b.Close(); err != nil && !errors.Is(err, ErrClosed) {
+			t.Errorf("Close: %v", err)
+		}
+	})
+	return b
+}
+
+// mustPut puts every key with its value.
+func mustPut(t *testing.T, b *BitCaspy, kv ...string) {
+	t.Helper()
+	for i := 0; i+1 < len(kv); i += 2 {
+		if err := b.Put(kv[i], []byte(kv[i+1])); err != nil {
+			t.Fatalf("Put(%q): %v", kv[i], err)
+		}
+	}
+}
+
+// assertGet checks that the key holds the value.
+func assertGet(t *testing.T, b *BitCaspy, key, want string) {
+	t.Helper()
+	got, err := b.Get(key)
+	if err != nil {
+		t.Fatalf("Get(%q): %v", key, err)
+	}
+	if string(got) != want {
+		t.Fatalf("Get(%q) = %q, want %q", key, got, want)
+	}
+}
+
+// assertErr checks that getting the key fails with the error.
+func assertErr(t *testing.T, b *BitCaspy, key string, want error) {
+	t.Helper()
+	if _, err := b.Get(key); !errors.Is(err, want) {
+		t.Fatalf("Get(%q) error = %v, want %v", key, err, want)
+	}
+}
+
+// listDir returns the size of every file in the directory by name.
+func listDir(t *testing.T, dir string) map[string]int64 {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string]int64, len(entries))
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[e.Name()] = info.Size()
+	}
+	return files
+}
+
+func TestReadOnlyWritesNothing(t *testing.T) {
+	t.Run("empty", func(t *testing.T) {
+		dir := t.TempDir()
+		b := reopenTest(t, dir, WithReadOnly())
+		assertErr(t, b, "k", ErrNoKey)
+		if err := b.Sync(); err != nil {
+			t.Fatalf("Sync: %v", err)
+		}
+		b.Close()
+		if files := listDir(t, dir); len(files) != 0 {
+			t.Fatalf("read-only open of an empty store left %v", files)
+		}
+	})
+
+	t.Run("existing", func(t *testing.T) {
+		b, dir := openTest(t)
+		mustPut(t, b, "k1", "v1", "k2", "v2")
+		b.Close()
+		before := listDir(t, dir)
+
+		b = reopenTest(t, dir, WithReadOnly())
+		assertGet(t, b, "k1", "v1")
+		assertGet(t, b, "k2", "v2")
+		if err := b.Put("k3", []byte("v3")); !errors.Is(err, ErrReadOnly) {
+			t.Fatalf("Put error = %v, want ErrReadOnly", err)
+		}
+		it := b.NewIterator(IteratorOptions{})
+		n := 0
+		for ; it.Valid(); it.Next() {
+			n++
+		}
+		it.Close()
+		if n != 2 {
+			t.Fatalf("iterator saw %d keys, want 2", n)
+		}
+		b.Close()
+
+		if after := listDir(t, dir); !reflect.DeepEqual(after, before) {
+			t.Fatalf("read-only open changed the store from %v to %v", before, after)
+		}
+	})
+}
+
+// assertTTL checks that the remaining lifetime of the key is within (max-slack, max].
+func assertTTL(t *testing.T, b *BitCaspy, key string, max time.Duration) {
+	t.Helper()
+	ttl, err := b.TTL(key)
+	if err != nil {
+		t.Fatalf("TTL(%q): %v", key, err)
+	}
+	if ttl > max || ttl <= max-time.Minute {
+		t.Fatalf("TTL(%q) = %s, want about %s", key, ttl, max)
+	}
+}
+
+func TestExpireTTLPersist(t *testing.T) {
+	b, dir := openTest(t)
+	mustPut(t, b, "k", "v")
+	if ttl, err := b.TTL("k"); err != nil || ttl != 0 {
+		t.Fatalf("TTL of a key without expiry = %s, %v, want 0", ttl, err)
+	}
+
+	if err := b.Expire("k", time.Hour); err != nil {
+		t.Fatalf("Expire: %v", err)
+	}
+	assertGet(t, b, "k", "v")
+	assertTTL(t, b, "k", time.Hour)
+
+	// Expire replaces the previous expiry
+	if err := b.Expire("k", 2*time.Hour); err != nil {
+		t.Fatalf("Expire: %v", err)
+	}
+	assertTTL(t, b, "k", 2*time.Hour)
+
+	// The expiry survives a restart
+	b.Close()
+	b = reopenTest(t, dir)
+	assertGet(t, b, "k", "v")
+	assertTTL(t, b, "k", 2*time.Hour)
+
+	if err := b.Persist("k"); err != nil {
+		t.Fatalf("Persist: %v", err)
+	}
+	if ttl, err := b.TTL("k"); err != nil || ttl != 0 {
+		t.Fatalf("TTL after Persist = %s, %v, want 0", ttl, err)
+	}
+	assertGet(t, b, "k", "v")
+
+	// Persisting a key without expiry writes nothing
+	size, err := b.df.Size()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Persist("k"); err != nil {
+		t.Fatalf("Persist: %v", err)
+	}
+	if after, _ := b.df.Size(); after != size {
+		t.Fatalf("Persist of a key without expiry grew the datafile from %d to %d bytes", size, after)
+	}
+
+	b.Close()
+	b = reopenTest(t, dir)
+	if ttl, err := b.TTL("k"); err != nil || ttl != 0 {
+		t.Fatalf("TTL after Persist and restart = %s, %v, want 0", ttl, err)
+	}
+}
+
+func TestExpireErrors(t *testing.T) {
+	b, dir := openTest(t)
+	mustPut(t, b, "k", "v")
+
+	for _, tc := range []struct {
+		name      string
+		err, want error
+	}{
+		{"Expire of a missing key", b.Expire("missing", time.Hour), ErrNoKey},
+		{"Persist of a missing key", b.Persist("missing"), ErrNoKey},
+		{"Expire with a zero ttl", b.Expire("k", 0), ErrInvalidTTL},
+		{"Expire with a negative ttl", b.Expire("k", -time.Second), ErrInvalidTTL},
+		{"PutWithTTL with a zero ttl", b.PutWithTTL("k", []byte("v"), 0), ErrInvalidTTL},
+	} {
+		if !errors.Is(tc.err, tc.want) {
+			t.Errorf("%s: error = %v, want %v", tc.name, tc.err, tc.want)
+		}
+	}
+	if _, err := b.TTL("missing"); !errors.Is(err, ErrNoKey) {
+		t.Errorf("TTL of a missing key: error = %v, want ErrNoKey", err)
+	}
+	assertGet(t, b, "k", "v")
+
+	// An expired key can't be brought back by Expire or Persist
+	if err := b.PutWithTTL("gone", []byte("v"), time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	assertErr(t, b, "gone", ErrExpiredKey)
+	if _, err := b.TTL("gone"); !errors.Is(err, ErrExpiredKey) {
+		t.Errorf("TTL of an expired key: error = %v, want ErrExpiredKey", err)
+	}
+	if err := b.Expire("gone", time.Hour); !errors.Is(err, ErrExpiredKey) {
+		t.Errorf("Expire of an expired key: error = %v, want ErrExpiredKey", err)
+	}
+	if err := b.Persist("gone"); !errors.Is(err, ErrExpiredKey) {
+		t.Errorf("Persist of an expired key: error = %v, want ErrExpiredKey", err)
+	}
+
+	b.Close()
+	b = reopenTest(t, dir, WithReadOnly())
+	if err := b.Expire("k", time.Hour); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Expire in read-only mode: error = %v, want ErrReadOnly", err)
+	}
+	if err := b.Persist("k"); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Persist in read-only mode: error = %v, want ErrReadOnly", err)
+	}
+	if ttl, err := b.TTL("k"); err != nil || ttl != 0 {
+		t.Errorf("TTL in read-only mode = %s, %v, want 0", ttl, err)
+	}
+}
+
+func TestClosed(t *testing.T) {
+	for _, durability := range []Durability{SyncNone, SyncGroupCommit} {
+		t.Run(durability.String(), func(t *testing.T) {
+			b, _ := openTest(t, WithDurability(durability))
+			mustPut(t, b, "k", "v")
+			if err := b.Close(); err != nil {
+				t.Fatalf("Close: %v", err)
+			}
+
+			batch := b.NewBatch()
+			if err := batch.Put("k", []byte("v")); err != nil {
+				t.Fatal(err)
+			}
+			it := b.NewIterator(IteratorOptions{})
+			defer it.Close()
+			ctx := context.Background()
+			for _, tc := range []struct {
+				name string
+				err  error
+			}{
+				{"Close", b.Close()},
+				{"Put", b.Put("k", []byte("v"))},
+				{"PutWithOptions", b.PutWithOptions(ctx, "k", []byte("v"), WriteOptions{Sync: true})},
+				{"PutWithTTL", b.PutWithTTL("k", []byte("v"), time.Hour)},
+				{"Delete", b.Delete("k")},
+				{"Expire", b.Expire("k", time.Hour)},
+				{"Persist", b.Persist("k")},
+				{"Sync", b.Sync()},
+				{"RotateActiveFile", b.RotateActiveFile()},
+				{"Batch.Commit", batch.Commit()},
+				{"View", b.View(func(*Tx) error { return nil })},
+				{"Update", b.Update(func(tx *Tx) error { return tx.Put("k", []byte("v")) })},
+				{"Iterator", it.Err()},
+			} {
+				if !errors.Is(tc.err, ErrClosed) {
+					t.Errorf("%s: error = %v, want ErrClosed", tc.name, tc.err)
+				}
+			}
+
+			if _, err := b.Get("k"); !errors.Is(err, ErrClosed) {
+				t.Errorf("Get: error = %v, want ErrClosed", err)
+			}
+			if _, err := b.TTL("k"); !errors.Is(err, ErrClosed) {
+				t.Errorf("TTL: error = %v, want ErrClosed", err)
+			}
+			if _, err := b.Merge(ctx); !errors.Is(err, ErrClosed) {
+				t.Errorf("Merge: error = %v, want ErrClosed", err)
+			}
+			if _, err := b.CompactRange(ctx, 0, 10); !errors.Is(err, ErrClosed) {
+				t.Errorf("CompactRange: error = %v, want ErrClosed", err)
+			}
+			if _, err := Fold(b, 0, func(string, []byte, int) (int, error) { return 0, nil }); !errors.Is(err, ErrClosed) {
+				t.Errorf("Fold: error = %v, want ErrClosed", err)
+			}
+			if _, err := FoldKeys(b, 0, func(string, int) (int, error) { return 0, nil }); !errors.Is(err, ErrClosed) {
+				t.Errorf("FoldKeys: error = %v, want ErrClosed", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,101 @@
+package bitcasgo
+
+import (
+	"fmt"
+	"hash/crc32"
+	"hash/crc64"
+)
+
+// Checksum is the algorithm used to checksum the records of a store. Every record
+// is checksummed over its header fields, key and value. The algorithm is picked
+// when the store is created and recorded in the preamble of its files.
+type Checksum byte
+
+const (
+	// ChecksumCRC32 is CRC-32 with the IEEE polynomial, the default for new stores.
+	ChecksumCRC32 Checksum = iota + 1
+	// ChecksumCRC32C is CRC-32 with the Castagnoli polynomial, which is hardware
+	// accelerated on most CPUs.
+	ChecksumCRC32C
+	// ChecksumCRC64 is CRC-64 with the ECMA polynomial, which makes collisions
+	// far less likely for large records.
+	ChecksumCRC64
+)
+
+var checksumNames = map[Checksum]string{
+	ChecksumCRC32:  "crc32",
+	ChecksumCRC32C: "crc32c",
+	ChecksumCRC64:  "crc64",
+}
+
+var (
+	castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+	ecmaTable       = crc64.MakeTable(crc64.ECMA)
+)
+
+func (c Checksum) String() string {
+	if name, ok := checksumNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("Checksum(%d)", int(c))
+}
+
+// parseChecksum parses the name of a checksum algorithm as returned by String.
+func parseChecksum(name string) (Checksum, error) {
+	for c, n := range checksumNames {
+		if n == name {
+			return c, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown checksum algorithm %q", name)
+}
+
+// sum returns the checksum of the concatenated data. 32 bit checksums are zero extended.
+func (c Checksum) sum(data ...[]byte) uint64 {
+	var crc uint64
+	for _, d := range data {
+		crc = c.update(crc, d)
+	}
+	return crc
+}
+
+// update returns the checksum crc of some data extended with more data.
+func (c Checksum) update(crc uint64, data []byte) uint64 {
+	switch c {
+	case ChecksumCRC32C:
+		return uint64(crc32.Update(uint32(crc), castagnoliTable, data))
+	case ChecksumCRC64:
+		return crc64.Update(crc, ecmaTable, data)
+	default:
+		return uint64(crc32.Update(uint32(crc), crc32.IEEETable, data))
+	}
+}
+
+// WithChecksum sets the checksum algorithm of a new store. Existing stores keep
+// the algorithm they were created with and refuse a different one, Migrate
+// rewrites a store with another algorithm.
+func WithChecksum(c Checksum) Config {
+	return func(o *Options) error {
+		if _, ok := checksumNames[c]; !ok {
+			return &OptionError{Option: "checksum", Value: c, Reason: "unknown checksum algorithm"}
+		}
+		o.checksum = c
+		return nil
+	}
+}
+
+// resolveChecksum settles the checksum algorithm of a store whose files use the
+// given one, zero for a new store.
+func (o *Options) resolveChecksum(store Checksum) error {
+	switch {
+	case store == 0:
+		if o.checksum == 0 {
+			o.checksum = ChecksumCRC32
+		}
+	case o.checksum == 0:
+		o.checksum = store
+	case o.checksum != store:
+		return &OptionError{Option: "checksum", Value: o.checksum, Reason: fmt.Sprintf("store uses %s, rewrite it with Migrate to change it", store)}
+	}
+	return nil
+}
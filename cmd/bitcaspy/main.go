@@ -2,10 +2,17 @@ package main
 
 import (
 	"bitcasgo"
+	"flag"
 	"fmt"
+	"os"
+	"sort"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		os.Exit(migrate(os.Args[2:]))
+	}
+
 	// Initialize Bitcaspy with default config
 	bc, err := bitcasgo.Init()
 	if err != nil {
@@ -32,3 +39,55 @@ func main() {
 	}
 	fmt.Printf("Got value: %s\n", string(val))
 }
+
+// migrate rewrites the store in the source directory into the destination
+// directory in the current format and prints a summary of what was done.
+func migrate(args []string) int {
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	legacyDeletes := fs.Bool("legacy-deletes", false, "read empty values of version 0 datafiles as deletes")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: bitcaspy migrate [-legacy-deletes] <src dir> <dst dir>")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return 2
+	}
+	args = fs.Args()
+
+	var cfg []bitcasgo.Config
+	if *legacyDeletes {
+		cfg = append(cfg, bitcasgo.WithLegacyDeletes())
+	}
+	report, err := bitcasgo.Migrate(args[0], args[1], cfg...)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to migrate: %v\n", err)
+		return 1
+	}
+
+	versions := make([]int, 0, len(report.SourceVersions))
+	for version := range report.SourceVersions {
+		versions = append(versions, version)
+	}
+	sort.Ints(versions)
+
+	fmt.Printf("Migrated %s to %s\n", args[0], args[1])
+	for _, version := range versions {
+		fmt.Printf("  datafiles of format version %d: %d\n", version, report.SourceVersions[version])
+	}
+	fmt.Printf("  datafiles read:    %d (%d bytes)\n", report.FilesRead, report.BytesRead)
+	fmt.Printf("  datafiles written: %d (%d bytes)\n", report.FilesWritten, report.BytesWritten)
+	fmt.Printf("  records copied:    %d (%d tombstones)\n", report.Records, report.Tombstones)
+	fmt.Printf("  bytes discarded:   %d\n", report.DiscardedBytes)
+	if report.EmptyLegacyValues > 0 {
+		action := "kept as empty values, use -legacy-deletes if they were deletes"
+		if *legacyDeletes {
+			action = "read as deletes"
+		}
+		fmt.Printf("  empty values of version 0 datafiles: %d, %s\n", report.EmptyLegacyValues, action)
+	}
+	return 0
+}
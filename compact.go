@@ -1,24 +1,30 @@
 package bitcasgo
 
-import (
-	"fmt"
-	"os"
-	"path/filepath"
-	"time"
-
-	datafile "bitcasgo/internal"
-)
+import "time"
 
 // checkFileSize delegates to rotateDf checks the file size for the mac file size
-// then places it into stale data files and creates a new data file
+// then places it into stale data files and creates a new data file.
+// Writes already rotate before crossing the max file size, this mostly writes
+// the hint files of the datafiles they made immutable.
 func (b *BitCaspy) checkFileSize(evalInterval time.Duration) {
-	var (
-		evalTicker = time.NewTicker(evalInterval).C
-	)
+	defer b.wg.Done()
+
+	evalTicker := time.NewTicker(evalInterval)
+	defer evalTicker.Stop()
+
+	for {
+		select {
+		case <-b.ctx.Done():
+			return
+		case <-evalTicker.C:
+		}
 
-	for range evalTicker {
 		if err := b.rotateDf(); err != nil {
-			fmt.Errorf("failed to scan the active file: %v", err)
+			b.lo.Error("failed to scan the active file", "error", err)
+		}
+		// Write hints for the datafiles which became immutable
+		if err := b.genrateHintFiles(); err != nil {
+			b.lo.Error("Error generating hint file", "error", err)
 		}
 	}
 }
@@ -28,10 +34,18 @@ func (b *BitCaspy) checkFileSize(evalInterval time.Duration) {
 // and merge old inactive db files in a single file. It also generates a hints file
 // which helps in caching all the keys during a cold start.
 func (b *BitCaspy) runCompaction(evalInterval time.Duration) {
-	var (
-		evalTicker = time.NewTicker(evalInterval).C
-	)
-	for range evalTicker {
+	defer b.wg.Done()
+
+	evalTicker := time.NewTicker(evalInterval)
+	defer evalTicker.Stop()
+
+	for {
+		select {
+		case <-b.ctx.Done():
+			return
+		case <-evalTicker.C:
+		}
+
 		if err := b.deleteIfExpired(); err != nil {
 			b.lo.Error("Error deleting expired datafiles", "error", err)
 		}
@@ -49,6 +63,9 @@ func (b *BitCaspy) runCompaction(evalInterval time.Duration) {
 func (b *BitCaspy) rotateDf() error {
 	b.Lock()
 	defer b.Unlock()
+	if b.closed.Load() {
+		return ErrClosed
+	}
 
 	size, err := b.df.Size()
 	if err != nil {
@@ -59,112 +76,108 @@ func (b *BitCaspy) rotateDf() error {
 	if size < b.opts.maxActiveFileSize {
 		return nil
 	}
-	oldId := b.df.ID()
+	return b.rotate(b.df.ID() + 1)
+}
+
+// RotateActiveFile makes the active datafile immutable and starts a new one,
+// regardless of its size. Nothing is done if the active datafile is empty.
+func (b *BitCaspy) RotateActiveFile() error {
+	if b.opts.readOnly {
+		return ErrReadOnly
+	}
 
-	b.stale[oldId] = b.df
-	newDf, err := datafile.New(b.opts.dir, oldId+1)
+	b.Lock()
+	if b.closed.Load() {
+		b.Unlock()
+		return ErrClosed
+	}
+	size, err := b.df.Size()
+	if err == nil && size > preambleSize {
+		err = b.rotate(b.df.ID() + 1)
+	}
+	b.Unlock()
 	if err != nil {
 		return err
 	}
-	b.df = newDf
-	return nil
-}
 
-// Encode the keyDir hashmap into gob
-func (b *BitCaspy) genrateHintFiles() error {
-	hintFile := filepath.Join(b.opts.dir, HINTS_FILE)
+	// Write hints for the datafile which became immutable
+	return b.genrateHintFiles()
+}
 
-	err := b.KeyDir.Encode(hintFile)
+// rotate places the active datafile into the stale datafiles and opens a new
+// active datafile with the given id. The caller must hold the lock.
+func (b *BitCaspy) rotate(id int) error {
+	newDf, err := openDataFile(b.opts.dir, id, b.storeID, b.opts.checksum)
 	if err != nil {
 		return err
 	}
-	return nil
-}
 
-func (b *BitCaspy) deleteIfExpired() error {
-	// Iterate over all keys and delete all keys which are expired.
-	keyDir := b.KeyDir
-	for k := range keyDir {
-		record, err := b.get(k)
-		if err != nil {
-			fmt.Errorf("error %v", err)
-		}
-		if record.isExpired() {
-			if err := b.delete(k); err != nil {
-				return err
-			}
+	// A datafile holding nothing but its preamble isn't worth keeping around
+	if size, err := b.df.Size(); err == nil && size <= preambleSize {
+		if err := b.removeDataFile(b.df); err != nil {
+			b.lo.Error("Error removing empty data file", "id", b.df.ID(), "error", err)
 		}
+	} else {
+		b.stale[b.df.ID()] = b.df
 	}
+	b.df = newDf
 	return nil
 }
 
-func (b *BitCaspy) merge() error {
-	// Only merge when stale datafiles are more than 2
-	if len(b.stale) < 2 {
-		return nil
-	}
-	// Create a new datafile for storing the output of merged files.
-	// Use a temp directory to store the file and move to main directory after merge is over.
-	tmpMergeDir, err := os.MkdirTemp("", "merged")
-	if err != nil {
-		return err
+// deleteIfExpired writes tombstones for every expired key so they are purged
+// from the keydir and dropped by the next merge. Records failing their checksum are skipped. The records are read through a
+// snapshot without holding the lock, which is only taken to write the tombstones
+// of the keys that weren't written to in the meantime.
+func (b *BitCaspy) deleteIfExpired() error {
+	b.RLock()
+	if b.closed.Load() {
+		b.RUnlock()
+		return ErrClosed
 	}
+	snap := b.newSnapshot()
+	b.RUnlock()
+	defer b.releaseSnapshot(snap)
 
-	defer os.RemoveAll(tmpMergeDir)
-	newFile, err := datafile.New(tmpMergeDir, 0)
-	if err != nil {
-		b.lo.Error("Error creating new datafile", "error", err)
+	type expiredKey struct {
+		key string
+		seq uint64
 	}
-
-	// Loop over all the active keys from the keydir and
-	// Since the keydir has updated values of all keys, all the old keys which are expired/deleted/overwritten
-	// will be cleaned up in the merged database.
-
-	for k := range b.KeyDir {
-		record, err := b.get(k)
-		if err != nil {
-			return err
+	var (
+		expired []expiredKey
+		err     error
+	)
+	snap.keyDir.Range("", "", false, func(k string, meta Meta) bool {
+		var record Record
+		if record, err = snap.read(k, meta); err != nil {
+			return false
 		}
-
-		if err := b.put(newFile, k, record.Value, nil); err != nil {
-			return err
+		// A corrupt record isn't deleted on the word of its expiry, reads report it instead
+		if !record.isValidChecksum(snap.checksum) {
+			b.lo.Warn("Skipping corrupt record while deleting expired keys", "key", k, "id", meta.fileId)
+			return true
 		}
-	}
-
-	// close all the stale datafiles because all the stale datafiles are merged into new datafile
-	for _, df := range b.stale {
-		if err := df.Close(); err != nil {
-			return err
+		if record.isExpired() {
+			expired = append(expired, expiredKey{key: k, seq: meta.seq})
 		}
+		return true
+	})
+	if err != nil || len(expired) == 0 {
+		return err
 	}
 
-	// Reset the stale hashmap to none because all the stale datafiles are merged into new datafile
-	b.stale = make(map[int]*datafile.DataFile, 0)
-
-	// Delete all old .db datafiles
-	err = filepath.Walk(b.opts.dir, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-		if info.IsDir() {
-			return nil
+	b.Lock()
+	defer b.Unlock()
+	if b.closed.Load() {
+		return ErrClosed
+	}
+	for _, e := range expired {
+		// The key was written to since the snapshot, so its expiry no longer holds
+		if meta, ok := b.KeyDir.Get(e.key); !ok || meta.seq != e.seq {
+			continue
 		}
-
-		if filepath.Ext(path) == ".db" {
-			err := os.Remove(path)
-			if err != nil {
-				return err
-			}
+		if err := b.delete(e.key); err != nil {
+			return err
 		}
-		return nil
-	})
-
-	// Move the new merged datafile to the old database directory and delete all old datafiles
-	os.Rename(filepath.Join(tmpMergeDir, fmt.Sprintf(datafile.ACTIVE_DATAFILE, 0)),
-		filepath.Join(b.opts.dir, fmt.Sprintf(datafile.ACTIVE_DATAFILE, 0)))
-
-	b.df = newFile
-
-	b.df.Sync()
+	}
 	return nil
 }
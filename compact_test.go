@@ -0,0 +1,85 @@
+package bitcasgo
+
+import (
+	"encoding/binary"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestDeleteIfExpired(t *testing.T) {
+	b, dir := openTest(t)
+	if err := b.PutWithTTL("gone", []byte("v"), time.Nanosecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.PutWithTTL("kept", []byte("v"), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	mustPut(t, b, "plain", "v")
+	time.Sleep(time.Millisecond)
+
+	if err := b.deleteIfExpired(); err != nil {
+		t.Fatalf("deleteIfExpired: %v", err)
+	}
+	if _, ok := b.KeyDir.Get("gone"); ok {
+		t.Fatal("expired key is still in the keydir")
+	}
+	assertGet(t, b, "kept", "v")
+	assertGet(t, b, "plain", "v")
+
+	// The tombstone survives a restart
+	b.Close()
+	b = reopenTest(t, dir)
+	assertErr(t, b, "gone", ErrNoKey)
+	assertGet(t, b, "kept", "v")
+}
+
+func TestDeleteIfExpiredConcurrentWrites(t *testing.T) {
+	b, _ := openTest(t)
+	for i := 0; i < 100; i++ {
+		if err := b.PutWithTTL(fmt.Sprintf("k%02d", i), []byte("v"), time.Nanosecond); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(time.Millisecond)
+
+	done := make(chan error)
+	go func() { done <- b.deleteIfExpired() }()
+	// Keys put again without an expiry while the scan runs must never be deleted
+	for i := 0; i < 100; i++ {
+		mustPut(t, b, fmt.Sprintf("k%02d", i), "new")
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("deleteIfExpired: %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		assertGet(t, b, fmt.Sprintf("k%02d", i), "new")
+	}
+}
+
+func TestDeleteIfExpiredSkipsCorruptRecords(t *testing.T) {
+	b, dir := openTest(t)
+	if err := b.PutWithTTL("k", []byte("v"), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	id := b.df.ID()
+	if err := b.RotateActiveFile(); err != nil {
+		t.Fatal(err)
+	}
+	b.Close()
+
+	// A flipped expiry makes the record look long expired
+	editFile(t, b.dataPath(id), func(data []byte) []byte {
+		binary.LittleEndian.PutUint64(data[preambleSize+16:], 1)
+		return data
+	})
+
+	b = reopenTest(t, dir)
+	assertErr(t, b, "k", ErrChecksumMismatch)
+	if err := b.deleteIfExpired(); err != nil {
+		t.Fatalf("deleteIfExpired: %v", err)
+	}
+	if _, ok := b.KeyDir.Get("k"); !ok {
+		t.Fatal("corrupt record was deleted as expired")
+	}
+}
@@ -0,0 +1,204 @@
+package bitcasgo
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Compressor compresses the values of records. Every compressed record carries the
+// id of its compressor, so datafiles mixing compressed and uncompressed records, or
+// records compressed by different compressors, remain readable.
+type Compressor interface {
+	// ID identifies the compressor in the records it compressed. It must never
+	// change once records were written with it. Ids below 16 are reserved for the
+	// compressors of this package.
+	ID() byte
+	Compress(value []byte) ([]byte, error)
+	Decompress(data []byte) ([]byte, error)
+}
+
+// Ids of the built in compressors.
+const (
+	compressorFlate byte = 1
+	compressorGzip  byte = 2
+
+	reservedCompressorIDs = 16
+)
+
+// ErrUnknownCompressor is returned when reading a record compressed by a compressor
+// which isn't set with WithCompression.
+var ErrUnknownCompressor = errors.New("record compressed by an unknown compressor")
+
+// NewFlateCompressor returns a compressor using DEFLATE at the given level of compress/flate.
+func NewFlateCompressor(level int) Compressor {
+	return flateCompressor{level: level}
+}
+
+// NewGzipCompressor returns a compressor using gzip at the given level of compress/gzip.
+func NewGzipCompressor(level int) Compressor {
+	return gzipCompressor{level: level}
+}
+
+type flateCompressor struct {
+	level int
+}
+
+func (c flateCompressor) ID() byte {
+	return compressorFlate
+}
+
+func (c flateCompressor) Compress(value []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, c.level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(value); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c flateCompressor) Decompress(data []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(data))
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+type gzipCompressor struct {
+	level int
+}
+
+func (c gzipCompressor) ID() byte {
+	return compressorGzip
+}
+
+func (c gzipCompressor) Compress(value []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := gzip.NewWriterLevel(&buf, c.level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(value); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c gzipCompressor) Decompress(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// builtinCompressors decompress the records written by the compressors of this package
+// whatever the compressor of the store is. Their level only matters for compressing.
+var builtinCompressors = map[byte]Compressor{
+	compressorFlate: NewFlateCompressor(flate.DefaultCompression),
+	compressorGzip:  NewGzipCompressor(gzip.DefaultCompression),
+}
+
+// compressorNames maps the names accepted in config files and the environment to
+// the built in compressors at their default level.
+var compressorNames = map[string]Compressor{
+	"flate": builtinCompressors[compressorFlate],
+	"gzip":  builtinCompressors[compressorGzip],
+}
+
+// parseCompressor parses the name of a built in compressor, "none" turns compression off.
+func parseCompressor(name string) (Compressor, error) {
+	if name == "none" {
+		return nil, nil
+	}
+	if c, ok := compressorNames[name]; ok {
+		return c, nil
+	}
+	return nil, fmt.Errorf("unknown compressor %q", name)
+}
+
+// WithCompression compresses the values of at least minSize bytes with the compressor.
+// Smaller values, and values which don't shrink, are stored as they are. A nil
+// compressor turns compression off, records compressed before remain readable.
+func WithCompression(c Compressor, minSize int) Config {
+	return func(o *Options) error {
+		if minSize < 0 {
+			return &OptionError{Option: "compression_min_size", Value: minSize, Reason: "cannot be negative"}
+		}
+		if c != nil {
+			if err := checkCompressor(c); err != nil {
+				return &OptionError{Option: "compression", Value: c.ID(), Reason: err.Error()}
+			}
+		}
+		o.compressor = c
+		o.compressionMinSize = minSize
+		return nil
+	}
+}
+
+// checkCompressor rejects compressors which take the id of a built in one or fail
+// to compress an empty value, such as built in compressors with an invalid level.
+func checkCompressor(c Compressor) error {
+	_, builtin := c.(flateCompressor)
+	if _, ok := c.(gzipCompressor); ok {
+		builtin = true
+	}
+	if !builtin && c.ID() < reservedCompressorIDs {
+		return fmt.Errorf("ids below %d are reserved", reservedCompressorIDs)
+	}
+	if _, err := c.Compress(nil); err != nil {
+		return err
+	}
+	return nil
+}
+
+// compressValue returns the value as it's written to disk along with the flags of the
+// record. Compressed values are prefixed with the id of their compressor.
+func (o *Options) compressValue(value []byte) ([]byte, byte, error) {
+	if o.compressor == nil || len(value) < o.compressionMinSize || len(value) == 0 {
+		return value, 0, nil
+	}
+	data, err := o.compressor.Compress(value)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error compressing value: %w", err)
+	}
+	// Not worth it if it doesn't save anything
+	if len(data)+1 >= len(value) {
+		return value, 0, nil
+	}
+	return append([]byte{o.compressor.ID()}, data...), flagCompressed, nil
+}
+
+// decompressValue returns the value of the record as it was put.
+func (o *Options) decompressValue(r Record) ([]byte, error) {
+	if r.Header.Flags&flagCompressed == 0 {
+		return r.Value, nil
+	}
+	if len(r.Value) == 0 {
+		return nil, errors.New("error decompressing value: missing compressor id")
+	}
+	c, ok := builtinCompressors[r.Value[0]]
+	if o.compressor != nil && o.compressor.ID() == r.Value[0] {
+		c, ok = o.compressor, true
+	}
+	if !ok {
+		return nil, fmt.Errorf("%w: id %d", ErrUnknownCompressor, r.Value[0])
+	}
+	value, err := c.Decompress(r.Value[1:])
+	if err != nil {
+		return nil, fmt.Errorf("error decompressing value: %w", err)
+	}
+	return value, nil
+}
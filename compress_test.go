@@ -0,0 +1,163 @@
+package bitcasgo
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"context"
+	"errors"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// testCompressor is a custom compressor deflating values under its own id.
+type testCompressor struct {
+	id byte
+}
+
+func (c testCompressor) ID() byte {
+	return c.id
+}
+
+func (c testCompressor) Compress(value []byte) ([]byte, error) {
+	return NewFlateCompressor(flate.BestSpeed).Compress(value)
+}
+
+func (c testCompressor) Decompress(data []byte) ([]byte, error) {
+	return NewFlateCompressor(flate.BestSpeed).Decompress(data)
+}
+
+// isCompressed reports whether the record of the key is stored compressed.
+func isCompressed(t *testing.T, b *BitCaspy, key string) bool {
+	t.Helper()
+	b.RLock()
+	defer b.RUnlock()
+	record, err := b.get(key)
+	if err != nil {
+		t.Fatalf("get(%q): %v", key, err)
+	}
+	return record.Header.Flags&flagCompressed != 0
+}
+
+func TestCompressionMinSize(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		cfg  []Config
+	}{
+		{"put", nil},
+		{"group commit", []Config{WithDurability(SyncGroupCommit)}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			b, _ := openTest(t, append(tc.cfg, WithCompression(NewGzipCompressor(gzip.BestSpeed), 100))...)
+			small, large := strings.Repeat("x", 99), strings.Repeat("x", 100)
+			mustPut(t, b, "small", small, "large", large)
+
+			batch := b.NewBatch()
+			batch.Put("batch-small", []byte(small))
+			batch.Put("batch-large", []byte(large))
+			if err := batch.Commit(); err != nil {
+				t.Fatalf("Commit: %v", err)
+			}
+
+			for key, want := range map[string]bool{"small": false, "large": true, "batch-small": false, "batch-large": true} {
+				if got := isCompressed(t, b, key); got != want {
+					t.Errorf("%s compressed = %v, want %v", key, got, want)
+				}
+			}
+			assertGet(t, b, "small", small)
+			assertGet(t, b, "large", large)
+			assertGet(t, b, "batch-small", small)
+			assertGet(t, b, "batch-large", large)
+		})
+	}
+}
+
+func TestCompressionMixedDataFile(t *testing.T) {
+	b, dir := openTest(t)
+	plain := strings.Repeat("p", 1000)
+	mustPut(t, b, "plain", plain)
+	b.Close()
+
+	// Values which don't shrink are stored as they are next to compressed ones
+	random := make([]byte, 1000)
+	rand.New(rand.NewSource(1)).Read(random)
+	b = reopenTest(t, dir, WithCompression(NewFlateCompressor(flate.BestSpeed), 0))
+	flated := strings.Repeat("f", 1000)
+	mustPut(t, b, "flate", flated, "random", string(random))
+	if !isCompressed(t, b, "flate") || isCompressed(t, b, "random") {
+		t.Fatal("incompressible value was compressed or compressible one wasn't")
+	}
+	if err := b.RotateActiveFile(); err != nil {
+		t.Fatal(err)
+	}
+	b.Close()
+
+	// Another compressor, or none, still reads the records of the built in ones
+	for _, cfg := range [][]Config{
+		{WithCompression(NewGzipCompressor(gzip.BestCompression), 0)},
+		{WithCompression(nil, 0)},
+		nil,
+	} {
+		b = reopenTest(t, dir, cfg...)
+		assertGet(t, b, "plain", plain)
+		assertGet(t, b, "flate", flated)
+		assertGet(t, b, "random", string(random))
+		b.Close()
+	}
+
+	// Merged records stay compressed
+	b = reopenTest(t, dir, WithCompression(NewGzipCompressor(gzip.BestSpeed), 0))
+	mustPut(t, b, "gzip", strings.Repeat("g", 1000))
+	if err := b.RotateActiveFile(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Merge(context.Background()); err != nil {
+		t.Fatalf("Merge: %v", err)
+	}
+	if !isCompressed(t, b, "flate") || !isCompressed(t, b, "gzip") {
+		t.Fatal("merge decompressed the records")
+	}
+	assertGet(t, b, "flate", flated)
+	assertGet(t, b, "gzip", strings.Repeat("g", 1000))
+}
+
+func TestCustomCompressor(t *testing.T) {
+	c := testCompressor{id: 42}
+	b, dir := openTest(t, WithCompression(c, 0))
+	value := strings.Repeat("custom", 100)
+	mustPut(t, b, "k", value)
+	if !isCompressed(t, b, "k") {
+		t.Fatal("value wasn't compressed by the custom compressor")
+	}
+	if got := b.opts.compressor.ID(); got != 42 {
+		t.Fatalf("compressor id = %d, want 42", got)
+	}
+	b.Close()
+
+	b = reopenTest(t, dir, WithCompression(c, 0))
+	assertGet(t, b, "k", value)
+	b.Close()
+
+	// Only the custom compressor can read its records
+	b = reopenTest(t, dir, WithCompression(NewFlateCompressor(flate.BestSpeed), 0))
+	assertErr(t, b, "k", ErrUnknownCompressor)
+}
+
+func TestWithCompressionErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		cfg  Config
+	}{
+		{"reserved id", WithCompression(testCompressor{id: compressorGzip}, 0)},
+		{"invalid level", WithCompression(NewFlateCompressor(42), 0)},
+		{"negative min size", WithCompression(NewFlateCompressor(flate.BestSpeed), -1)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := Init(WithDir(t.TempDir()), tc.cfg)
+			var oe *OptionError
+			if !errors.As(err, &oe) {
+				t.Fatalf("Init error = %v, want an OptionError", err)
+			}
+		})
+	}
+}
@@ -1,24 +1,51 @@
 package bitcasgo
 
-import "time"
+import (
+	"fmt"
+	"os"
+	"time"
+)
 
 const (
 	defaultSyncInterval      = time.Minute * 1
 	defaultCompactInterval   = time.Hour * 6
 	defaultFileSizeInterval  = time.Minute * 1
 	defaultMaxActiveFileSize = int64(1 << 32) // 4GB.
+
+	// Values are only compressed from this size on, smaller ones rarely shrink.
+	defaultCompressionMinSize = 256
+
+	// Merge policy defaults as suggested by the bitcask paper.
+	defaultFragMergeTrigger      = 60.0
+	defaultDeadBytesMergeTrigger = int64(512 << 20) // 512MB.
+	defaultFragThreshold         = 40.0
+	defaultDeadBytesThreshold    = int64(128 << 20) // 128MB.
 )
 
 // Options represents configuration options for managing a datastore.
 type Options struct {
-	debug                 bool           // Enable debug logging.
-	dir                   string         // Path for storing data files.
-	readOnly              bool           // Whether this datastore should be opened in a read-only mode. Only one process at a time can open it in R-W mode.
-	alwaysFSync           bool           // Should flush filesystem buffer after every right.
-	syncInterval          *time.Duration // Interval to sync the active file on disk.
-	compactInterval       time.Duration  // Interval to compact old files.
-	checkFileSizeInterval time.Duration  // Interval to check the file size of the active DB.
-	maxActiveFileSize     int64          // Max size of active file in bytes. On exceeding this size it's rotated.
+	debug                 bool          // Enable debug logging.
+	dir                   string        // Path for storing data files.
+	readOnly              bool          // Whether this datastore should be opened in a read-only mode. Only one process at a time can open it in R-W mode.
+	durability            Durability    // When writes are synced to disk.
+	checksum              Checksum      // Algorithm checksumming the records, zero to keep the one of the store.
+	syncInterval          time.Duration // Interval to sync the active file on disk in the SyncInterval mode.
+	compactInterval       time.Duration // Interval to compact old files.
+	checkFileSizeInterval time.Duration // Interval to check the file size of the active DB.
+	maxActiveFileSize     int64         // Max size of active file in bytes. On exceeding this size it's rotated.
+	newKeyDir             func() KeyDir // Constructor of the index holding the keys.
+	compressor            Compressor    // Compresses the values, nil to store them as they are.
+	compressionMinSize    int           // Values smaller than this are never compressed.
+	legacyDeletes         bool          // Migrate reads empty values of version 0 datafiles as deletes.
+
+	fragMergeTrigger      float64 // Percentage of dead keys in a datafile which triggers a merge.
+	deadBytesMergeTrigger int64   // Dead bytes in a datafile which trigger a merge.
+	fragThreshold         float64 // Percentage of dead keys for a datafile to be included in a merge.
+	deadBytesThreshold    int64   // Dead bytes for a datafile to be included in a merge.
+	mergeWindowStart      int     // Hour of the day from which merges are allowed.
+	mergeWindowEnd        int     // Hour of the day until which merges are allowed.
+
+	mergeProgress func(MergeProgress) // Called as merges make progress.
 }
 
 func DefaultOptions() *Options {
@@ -26,15 +53,148 @@ func DefaultOptions() *Options {
 		debug:                 false,
 		dir:                   ".",
 		readOnly:              false,
-		alwaysFSync:           false,
+		durability:            SyncNone,
+		syncInterval:          defaultSyncInterval,
 		maxActiveFileSize:     defaultMaxActiveFileSize,
 		compactInterval:       defaultCompactInterval,
 		checkFileSizeInterval: defaultFileSizeInterval,
+		newKeyDir:             NewKeyDir,
+		compressionMinSize:    defaultCompressionMinSize,
+		fragMergeTrigger:      defaultFragMergeTrigger,
+		deadBytesMergeTrigger: defaultDeadBytesMergeTrigger,
+		fragThreshold:         defaultFragThreshold,
+		deadBytesThreshold:    defaultDeadBytesThreshold,
+		mergeWindowStart:      0,
+		mergeWindowEnd:        24,
 	}
 }
 
+// OptionError is returned by Init when an option is set to an invalid value.
+type OptionError struct {
+	Option string // Name of the option
+	Value  any    // Value it was set to
+	Reason string // Why the value is invalid
+}
+
+func (e *OptionError) Error() string {
+	return fmt.Sprintf("invalid option %s=%v: %s", e.Option, e.Value, e.Reason)
+}
+
+// validate checks that the options hold sane values.
+func (o *Options) validate() error {
+	switch {
+	case o.dir == "":
+		return &OptionError{Option: "dir", Value: o.dir, Reason: "cannot be empty"}
+	case durabilityNames[o.durability] == "":
+		return &OptionError{Option: "durability", Value: o.durability, Reason: "unknown durability mode"}
+	case o.checksum != 0 && checksumNames[o.checksum] == "":
+		return &OptionError{Option: "checksum", Value: o.checksum, Reason: "unknown checksum algorithm"}
+	case o.syncInterval <= 0:
+		return &OptionError{Option: "sync_interval", Value: o.syncInterval, Reason: "must be positive"}
+	case o.compactInterval <= 0:
+		return &OptionError{Option: "compact_interval", Value: o.compactInterval, Reason: "must be positive"}
+	case o.checkFileSizeInterval <= 0:
+		return &OptionError{Option: "check_file_size_interval", Value: o.checkFileSizeInterval, Reason: "must be positive"}
+	case o.maxActiveFileSize <= int64(preambleSize+headerSize):
+		return &OptionError{Option: "max_file_size", Value: o.maxActiveFileSize, Reason: fmt.Sprintf("must be more than %d bytes", preambleSize+headerSize)}
+	case o.compressionMinSize < 0:
+		return &OptionError{Option: "compression_min_size", Value: o.compressionMinSize, Reason: "cannot be negative"}
+	case o.newKeyDir == nil:
+		return &OptionError{Option: "keydir", Value: nil, Reason: "cannot be nil"}
+	case o.fragMergeTrigger < 0 || o.fragMergeTrigger > 100:
+		return &OptionError{Option: "frag_merge_trigger", Value: o.fragMergeTrigger, Reason: "must be a percentage"}
+	case o.fragThreshold < 0 || o.fragThreshold > 100:
+		return &OptionError{Option: "frag_threshold", Value: o.fragThreshold, Reason: "must be a percentage"}
+	case o.deadBytesMergeTrigger < 0:
+		return &OptionError{Option: "dead_bytes_merge_trigger", Value: o.deadBytesMergeTrigger, Reason: "cannot be negative"}
+	case o.deadBytesThreshold < 0:
+		return &OptionError{Option: "dead_bytes_threshold", Value: o.deadBytesThreshold, Reason: "cannot be negative"}
+	case o.mergeWindowStart < 0 || o.mergeWindowStart > 23:
+		return &OptionError{Option: "merge_window_start", Value: o.mergeWindowStart, Reason: "must be an hour of the day"}
+	case o.mergeWindowEnd < 0 || o.mergeWindowEnd > 24:
+		return &OptionError{Option: "merge_window_end", Value: o.mergeWindowEnd, Reason: "must be an hour of the day"}
+	}
+	return nil
+}
+
+// checkDir ensures the data directory exists and, unless the datastore is
+// opened read-only, that files can be created in it.
+func (o *Options) checkDir() error {
+	if err := os.MkdirAll(o.dir, 0o755); err != nil {
+		return &OptionError{Option: "dir", Value: o.dir, Reason: err.Error()}
+	}
+	if o.readOnly {
+		return nil
+	}
+	f, err := os.CreateTemp(o.dir, ".bitcaspy-probe-*")
+	if err != nil {
+		return &OptionError{Option: "dir", Value: o.dir, Reason: "not writable"}
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
 type Config func(*Options) error
 
+// WithDir sets the directory holding the datafiles. It's created if it doesn't exist.
+func WithDir(dir string) Config {
+	return func(o *Options) error {
+		if dir == "" {
+			return &OptionError{Option: "dir", Value: dir, Reason: "cannot be empty"}
+		}
+		o.dir = dir
+		return nil
+	}
+}
+
+// WithSyncInterval syncs the active datafile to disk at the given interval,
+// switching to the SyncInterval durability mode.
+func WithSyncInterval(interval time.Duration) Config {
+	return func(o *Options) error {
+		if interval <= 0 {
+			return &OptionError{Option: "sync_interval", Value: interval, Reason: "must be positive"}
+		}
+		o.durability = SyncInterval
+		o.syncInterval = interval
+		return nil
+	}
+}
+
+// WithDurability sets when writes are synced to disk. Single writes can still
+// be synced with WriteOptions regardless of the mode.
+func WithDurability(mode Durability) Config {
+	return func(o *Options) error {
+		if _, ok := durabilityNames[mode]; !ok {
+			return &OptionError{Option: "durability", Value: mode, Reason: "unknown durability mode"}
+		}
+		o.durability = mode
+		return nil
+	}
+}
+
+// WithCompactInterval sets how often expired keys are purged and the merge policy is evaluated.
+func WithCompactInterval(interval time.Duration) Config {
+	return func(o *Options) error {
+		if interval <= 0 {
+			return &OptionError{Option: "compact_interval", Value: interval, Reason: "must be positive"}
+		}
+		o.compactInterval = interval
+		return nil
+	}
+}
+
+// WithCheckFileSizeInterval sets how often the size of the active datafile is checked
+// and hint files are written for the immutable datafiles.
+func WithCheckFileSizeInterval(interval time.Duration) Config {
+	return func(o *Options) error {
+		if interval <= 0 {
+			return &OptionError{Option: "check_file_size_interval", Value: interval, Reason: "must be positive"}
+		}
+		o.checkFileSizeInterval = interval
+		return nil
+	}
+}
+
 func WithDebug() Config {
 	return func(o *Options) error {
 		o.debug = true
@@ -42,16 +202,95 @@ func WithDebug() Config {
 	}
 }
 
+// WithAlwaysSync syncs every write to disk before it returns, the same as
+// WithDurability(SyncGroupCommit).
 func WithAlwaysSync() Config {
+	return WithDurability(SyncGroupCommit)
+}
+
+func WithReadOnly() Config {
 	return func(o *Options) error {
-		o.alwaysFSync = true
+		o.readOnly = true
 		return nil
 	}
 }
 
-func WithReadOnly() Config {
-	return func (o *Options) error {
-		o.readOnly = true
+// WithMaxFileSize sets the max size of a datafile in bytes. The active datafile is
+// rotated before a write would grow it past this size.
+func WithMaxFileSize(size int64) Config {
+	return func(o *Options) error {
+		if size <= int64(preambleSize+headerSize) {
+			return &OptionError{Option: "max_file_size", Value: size, Reason: fmt.Sprintf("must be more than %d bytes", preambleSize+headerSize)}
+		}
+		o.maxActiveFileSize = size
+		return nil
+	}
+}
+
+// WithMergeTrigger sets when a merge is started: as soon as any immutable datafile
+// has at least the given percentage of dead keys or the given number of dead bytes.
+func WithMergeTrigger(fragmentation float64, deadBytes int64) Config {
+	return func(o *Options) error {
+		if fragmentation < 0 || fragmentation > 100 {
+			return &OptionError{Option: "frag_merge_trigger", Value: fragmentation, Reason: "must be a percentage"}
+		}
+		if deadBytes < 0 {
+			return &OptionError{Option: "dead_bytes_merge_trigger", Value: deadBytes, Reason: "cannot be negative"}
+		}
+		o.fragMergeTrigger = fragmentation
+		o.deadBytesMergeTrigger = deadBytes
+		return nil
+	}
+}
+
+// WithMergeThreshold sets which datafiles a triggered merge includes: those with at
+// least the given percentage of dead keys or the given number of dead bytes.
+func WithMergeThreshold(fragmentation float64, deadBytes int64) Config {
+	return func(o *Options) error {
+		if fragmentation < 0 || fragmentation > 100 {
+			return &OptionError{Option: "frag_threshold", Value: fragmentation, Reason: "must be a percentage"}
+		}
+		if deadBytes < 0 {
+			return &OptionError{Option: "dead_bytes_threshold", Value: deadBytes, Reason: "cannot be negative"}
+		}
+		o.fragThreshold = fragmentation
+		o.deadBytesThreshold = deadBytes
+		return nil
+	}
+}
+
+// WithMergeWindow restricts background merges to the hours of the day from start
+// until end, in local time. A window with start after end wraps around midnight.
+func WithMergeWindow(start, end int) Config {
+	return func(o *Options) error {
+		if start < 0 || start > 23 {
+			return &OptionError{Option: "merge_window_start", Value: start, Reason: "must be an hour of the day"}
+		}
+		if end < 0 || end > 24 {
+			return &OptionError{Option: "merge_window_end", Value: end, Reason: "must be an hour of the day"}
+		}
+		o.mergeWindowStart = start
+		o.mergeWindowEnd = end
 		return nil
 	}
-}
\ No newline at end of file
+}
+
+// WithMergeProgress sets a function which is called as merges make progress.
+// It's called from the goroutine running the merge and shouldn't block.
+func WithMergeProgress(fn func(MergeProgress)) Config {
+	return func(o *Options) error {
+		o.mergeProgress = fn
+		return nil
+	}
+}
+
+// WithKeyDir sets the constructor of the index holding the keys in memory.
+func WithKeyDir(newKeyDir func() KeyDir) Config {
+	return func(o *Options) error {
+		if newKeyDir == nil {
+			return &OptionError{Option: "keydir", Value: nil, Reason: "cannot be nil"}
+		}
+		o.newKeyDir = newKeyDir
+		return nil
+	}
+}
@@ -0,0 +1,47 @@
+package bitcasgo
+
+import "testing"
+
+func TestValidate(t *testing.T) {
+	for _, tc := range []struct {
+		option string
+		set    func(o *Options)
+	}{
+		{"dir", func(o *Options) { o.dir = "" }},
+		{"durability", func(o *Options) { o.durability = Durability(42) }},
+		{"checksum", func(o *Options) { o.checksum = Checksum(42) }},
+		{"sync_interval", func(o *Options) { o.syncInterval = 0 }},
+		{"compact_interval", func(o *Options) { o.compactInterval = -1 }},
+		{"check_file_size_interval", func(o *Options) { o.checkFileSizeInterval = 0 }},
+		{"max_file_size", func(o *Options) { o.maxActiveFileSize = preambleSize + headerSize }},
+		{"compression_min_size", func(o *Options) { o.compressionMinSize = -1 }},
+		{"keydir", func(o *Options) { o.newKeyDir = nil }},
+		{"frag_merge_trigger", func(o *Options) { o.fragMergeTrigger = 101 }},
+		{"frag_threshold", func(o *Options) { o.fragThreshold = -1 }},
+		{"dead_bytes_merge_trigger", func(o *Options) { o.deadBytesMergeTrigger = -1 }},
+		{"dead_bytes_threshold", func(o *Options) { o.deadBytesThreshold = -1 }},
+		{"merge_window_start", func(o *Options) { o.mergeWindowStart = 24 }},
+		{"merge_window_end", func(o *Options) { o.mergeWindowEnd = 25 }},
+	} {
+		t.Run(tc.option, func(t *testing.T) {
+			o := DefaultOptions()
+			tc.set(o)
+			assertOptionError(t, o.validate(), tc.option)
+
+			// Init refuses the options before touching the directory
+			dir := t.TempDir()
+			_, err := Init(WithDir(dir), func(o *Options) error {
+				tc.set(o)
+				return nil
+			})
+			assertOptionError(t, err, tc.option)
+			if files := listDir(t, dir); len(files) != 0 {
+				t.Fatalf("Init with invalid options left %v", files)
+			}
+		})
+	}
+
+	if err := DefaultOptions().validate(); err != nil {
+		t.Fatalf("default options: %v", err)
+	}
+}
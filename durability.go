@@ -0,0 +1,60 @@
+package bitcasgo
+
+import "fmt"
+
+// Durability sets when the writes of a store are synced to disk.
+type Durability int
+
+const (
+	// SyncNone leaves syncing to the OS, writes are only synced by Sync, batches and Close.
+	SyncNone Durability = iota
+	// SyncInterval syncs the active datafile periodically, see WithSyncInterval.
+	SyncInterval
+	// SyncEveryWrite syncs every write before it returns while holding the write lock.
+	SyncEveryWrite
+	// SyncGroupCommit syncs every write before it returns. Concurrent puts and
+	// deletes are committed in groups sharing a single write and fsync.
+	SyncGroupCommit
+)
+
+var durabilityNames = map[Durability]string{
+	SyncNone:        "none",
+	SyncInterval:    "interval",
+	SyncEveryWrite:  "every_write",
+	SyncGroupCommit: "group_commit",
+}
+
+func (d Durability) String() string {
+	if name, ok := durabilityNames[d]; ok {
+		return name
+	}
+	return fmt.Sprintf("Durability(%d)", int(d))
+}
+
+// parseDurability parses the name of a durability mode as returned by String.
+func parseDurability(name string) (Durability, error) {
+	for d, n := range durabilityNames {
+		if n == name {
+			return d, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown durability mode %q", name)
+}
+
+// syncsWrites reports whether every write is synced before it returns.
+func (d Durability) syncsWrites() bool {
+	return d == SyncEveryWrite || d == SyncGroupCommit
+}
+
+// WriteOptions adjusts how a single write is made.
+type WriteOptions struct {
+	// Sync syncs the write to disk before it returns, whatever the durability mode
+	// of the store. Concurrent synced writes share an fsync.
+	Sync bool
+}
+
+// groupCommits reports whether a write with the options goes through group commit.
+// Writes which have to be synced do, unless the store syncs every write under the lock.
+func (b *BitCaspy) groupCommits(opts WriteOptions) bool {
+	return b.opts.durability == SyncGroupCommit || (opts.Sync && b.opts.durability != SyncEveryWrite)
+}
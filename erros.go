@@ -13,5 +13,19 @@ var (
 	ErrLargeKey   = errors.New("invalid key: size cannot be more than 4294967296 bytes")
 	ErrNoKey      = errors.New("invalid key: key is either deleted or expired or unset")
 
+	ErrInvalidTTL = errors.New("invalid ttl: ttl must be positive")
+
+	ErrClosed = errors.New("database is closed")
+
+	ErrConflict   = errors.New("transaction conflict: keys were modified since the transaction began")
+	ErrTxReadOnly = errors.New("operation not allowed in a read only transaction")
+
+	ErrKeysOnly = errors.New("values are not available on a keys only iterator")
+
+	// ErrStopFold can be returned by a folding function to stop the fold early.
+	ErrStopFold = errors.New("fold stopped")
+
 	ErrLargeValue = errors.New("invalid value: size cannot be more than 4294967296 bytes")
+
+	ErrLargeRecord = errors.New("invalid record: size cannot be more than the max file size")
 )
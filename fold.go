@@ -0,0 +1,71 @@
+package bitcasgo
+
+import (
+	"context"
+	"errors"
+)
+
+// Fold calls fn for every live key and value in key order, passing the result
+// of each call on to the next one and returning the final accumulator.
+// Expired keys are skipped and corrupt records fail the fold with ErrChecksumMismatch,
+// the same as Get. Returning ErrStopFold from fn ends the fold early without an error.
+// The fold runs over a snapshot, so concurrent writes don't affect it.
+func Fold[T any](b *BitCaspy, acc T, fn func(key string, value []byte, acc T) (T, error)) (T, error) {
+	return FoldContext(context.Background(), b, acc, fn)
+}
+
+// FoldContext is like Fold but stops with the error of the context once it's done.
+func FoldContext[T any](ctx context.Context, b *BitCaspy, acc T, fn func(key string, value []byte, acc T) (T, error)) (T, error) {
+	it := b.NewIteratorContext(ctx, IteratorOptions{})
+	defer it.Close()
+
+	for ; it.Valid(); it.Next() {
+		value, err := it.Value()
+		if errors.Is(err, ErrExpiredKey) {
+			continue
+		}
+		if err != nil {
+			return acc, err
+		}
+
+		acc, err = fn(it.Key(), value, acc)
+		if errors.Is(err, ErrStopFold) {
+			return acc, nil
+		}
+		if err != nil {
+			return acc, err
+		}
+	}
+	return acc, it.Err()
+}
+
+// FoldKeys is like Fold but only passes the keys to fn. Values are never read,
+// only the record headers to skip expired keys.
+func FoldKeys[T any](b *BitCaspy, acc T, fn func(key string, acc T) (T, error)) (T, error) {
+	return FoldKeysContext(context.Background(), b, acc, fn)
+}
+
+// FoldKeysContext is like FoldKeys but stops with the error of the context once it's done.
+func FoldKeysContext[T any](ctx context.Context, b *BitCaspy, acc T, fn func(key string, acc T) (T, error)) (T, error) {
+	it := b.NewIteratorContext(ctx, IteratorOptions{KeysOnly: true})
+	defer it.Close()
+
+	for ; it.Valid(); it.Next() {
+		header, err := it.snap.readHeader(it.entries[it.pos].meta)
+		if err != nil {
+			return acc, err
+		}
+		if record := (Record{Header: header}); record.isExpired() {
+			continue
+		}
+
+		acc, err = fn(it.Key(), acc)
+		if errors.Is(err, ErrStopFold) {
+			return acc, nil
+		}
+		if err != nil {
+			return acc, err
+		}
+	}
+	return acc, it.Err()
+}
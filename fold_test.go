@@ -0,0 +1,120 @@
+package bitcasgo
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// foldStore puts a few keys, one of them expired and one deleted.
+func foldStore(t *testing.T) (*BitCaspy, string) {
+	t.Helper()
+	b, dir := openTest(t)
+	mustPut(t, b, "c", "3", "a", "1", "d", "4", "b", "2")
+	if err := b.PutWithTTL("expired", []byte("x"), time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Delete("d"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	return b, dir
+}
+
+func TestFold(t *testing.T) {
+	b, _ := foldStore(t)
+
+	got, err := Fold(b, "", func(key string, value []byte, acc string) (string, error) {
+		// Writes made during the fold don't show up in it
+		mustPut(t, b, "aa", "new")
+		return acc + key + "=" + string(value) + ",", nil
+	})
+	if err != nil {
+		t.Fatalf("Fold: %v", err)
+	}
+	if want := "a=1,b=2,c=3,"; got != want {
+		t.Fatalf("Fold = %q, want %q", got, want)
+	}
+
+	keys, err := FoldKeys(b, []string(nil), func(key string, acc []string) ([]string, error) {
+		return append(acc, key), nil
+	})
+	if err != nil {
+		t.Fatalf("FoldKeys: %v", err)
+	}
+	if got := strings.Join(keys, ","); got != "a,aa,b,c" {
+		t.Fatalf("FoldKeys = %s, want a,aa,b,c", got)
+	}
+}
+
+func TestFoldStop(t *testing.T) {
+	b, _ := foldStore(t)
+
+	// ErrStopFold ends the fold with the accumulator so far and no error
+	n, err := Fold(b, 0, func(key string, value []byte, acc int) (int, error) {
+		if key == "b" {
+			return acc, ErrStopFold
+		}
+		return acc + 1, nil
+	})
+	if err != nil || n != 1 {
+		t.Fatalf("Fold stopped at b = %d, %v, want 1, nil", n, err)
+	}
+	n, err = FoldKeys(b, 0, func(key string, acc int) (int, error) {
+		return acc + 1, ErrStopFold
+	})
+	if err != nil || n != 1 {
+		t.Fatalf("FoldKeys stopped at once = %d, %v, want 1, nil", n, err)
+	}
+
+	// Other errors fail the fold
+	boom := errors.New("boom")
+	n, err = Fold(b, 0, func(key string, value []byte, acc int) (int, error) {
+		if key == "c" {
+			return acc, boom
+		}
+		return acc + 1, nil
+	})
+	if !errors.Is(err, boom) || n != 2 {
+		t.Fatalf("Fold failing at c = %d, %v, want 2, boom", n, err)
+	}
+	if _, err := FoldKeys(b, 0, func(key string, acc int) (int, error) { return acc, boom }); !errors.Is(err, boom) {
+		t.Fatalf("FoldKeys error = %v, want boom", err)
+	}
+
+	// So does a done context
+	ctx, cancel := context.WithCancel(context.Background())
+	_, err = FoldContext(ctx, b, 0, func(key string, value []byte, acc int) (int, error) {
+		cancel()
+		return acc + 1, nil
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("FoldContext error = %v, want context.Canceled", err)
+	}
+	if _, err := FoldKeysContext(ctx, b, 0, func(key string, acc int) (int, error) { return acc, nil }); !errors.Is(err, context.Canceled) {
+		t.Fatalf("FoldKeysContext error = %v, want context.Canceled", err)
+	}
+}
+
+func TestFoldCorruptRecord(t *testing.T) {
+	b, dir := openTest(t)
+	mustPut(t, b, "a", "value1", "b", "value2")
+	id := b.df.ID()
+	b.Close()
+	editFile(t, b.dataPath(id), func(data []byte) []byte {
+		data[preambleSize+headerSize+len("a")] ^= 1
+		return data
+	})
+
+	b = reopenTest(t, dir, WithReadOnly())
+	if _, err := Fold(b, 0, func(string, []byte, int) (int, error) { return 0, nil }); !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("Fold error = %v, want ErrChecksumMismatch", err)
+	}
+	// Values aren't read by FoldKeys
+	n, err := FoldKeys(b, 0, func(key string, acc int) (int, error) { return acc + 1, nil })
+	if err != nil || n != 2 {
+		t.Fatalf("FoldKeys = %d, %v, want 2, nil", n, err)
+	}
+}
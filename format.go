@@ -0,0 +1,223 @@
+package bitcasgo
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"path/filepath"
+	"time"
+
+	datafile "bitcasgo/internal"
+)
+
+// formatVersion is the version of the on-disk format written by this package.
+// Datafiles written before files carried a preamble are version 0, version 1 added
+// the preamble and record flags, version 2 widened timestamps to nanoseconds and
+// added sequence numbers and version 3 checksums whole records with a selectable
+// algorithm. Older versions are upgraded with Migrate.
+const formatVersion = 3
+
+// fileMagic starts the preamble of every datafile and hint file.
+var fileMagic = [4]byte{'B', 'C', 'S', 'P'}
+
+// Kinds of files carrying a preamble.
+const (
+	fileKindData byte = 1
+	fileKindHint byte = 2
+)
+
+// preambleSize is the size in bytes of the preamble at the start of every datafile
+// and hint file: the magic, the format version, the kind of file, the checksum algorithm
+// of the records, the creation time in unix nanoseconds, the id of the store and a
+// CRC-32 of them. The checksum algorithm was a reserved byte before version 3.
+const preambleSize = 4 + 2 + 1 + 1 + 8 + 16 + 4
+
+// ErrUnsupportedFormat is returned by Init for datafiles in a format this version can't read.
+var ErrUnsupportedFormat = errors.New("unsupported file format")
+
+// FormatError describes a datafile whose format can't be read. It matches ErrUnsupportedFormat.
+type FormatError struct {
+	Path    string
+	Version int // Format version of the file, 0 for the legacy format without a preamble
+	Reason  string
+}
+
+func (e *FormatError) Error() string {
+	return fmt.Sprintf("%v: %s has format version %d, expected %d: %s", ErrUnsupportedFormat, e.Path, e.Version, formatVersion, e.Reason)
+}
+
+func (e *FormatError) Unwrap() error {
+	return ErrUnsupportedFormat
+}
+
+// storeID identifies a store. Every file of the store carries it in its preamble
+// so that files of different stores are never mixed up.
+type storeID [16]byte
+
+// newStoreID returns a random version 4 UUID.
+func newStoreID() (storeID, error) {
+	var id storeID
+	if _, err := rand.Read(id[:]); err != nil {
+		return id, err
+	}
+	id[6] = id[6]&0x0f | 0x40
+	id[8] = id[8]&0x3f | 0x80
+	return id, nil
+}
+
+func (id storeID) String() string {
+	return fmt.Sprintf("%x-%x-%x-%x-%x", id[0:4], id[4:6], id[6:8], id[8:10], id[10:16])
+}
+
+// preamble is the header of a datafile or hint file.
+type preamble struct {
+	Version  uint16
+	Kind     byte
+	Checksum Checksum
+	Created  time.Time
+	Store    storeID
+}
+
+func (p preamble) encode() []byte {
+	data := make([]byte, preambleSize)
+	copy(data, fileMagic[:])
+	binary.LittleEndian.PutUint16(data[4:], p.Version)
+	data[6] = p.Kind
+	data[7] = byte(p.Checksum)
+	binary.LittleEndian.PutUint64(data[8:], uint64(p.Created.UnixNano()))
+	copy(data[16:32], p.Store[:])
+	binary.LittleEndian.PutUint32(data[32:], crc32.ChecksumIEEE(data[:32]))
+	return data
+}
+
+// errNoPreamble is returned for files which don't start with a preamble,
+// which is the case for the legacy format.
+var errNoPreamble = errors.New("no preamble")
+
+func decodePreamble(data []byte) (preamble, error) {
+	var p preamble
+	if len(data) < preambleSize || !bytes.Equal(data[:4], fileMagic[:]) {
+		return p, errNoPreamble
+	}
+	if crc32.ChecksumIEEE(data[:32]) != binary.LittleEndian.Uint32(data[32:]) {
+		return p, errors.New("preamble checksum mismatch")
+	}
+	p.Version = binary.LittleEndian.Uint16(data[4:])
+	p.Kind = data[6]
+	p.Checksum = Checksum(data[7])
+	p.Created = time.Unix(0, int64(binary.LittleEndian.Uint64(data[8:])))
+	copy(p.Store[:], data[16:32])
+	return p, nil
+}
+
+// openDataFile opens the datafile with the id, writing the preamble of the store
+// and its checksum algorithm to it if it's new.
+func openDataFile(dir string, id int, store storeID, c Checksum) (*datafile.DataFile, error) {
+	df, err := datafile.New(dir, id)
+	if err != nil {
+		return nil, err
+	}
+	if df.Offset() > 0 {
+		return df, nil
+	}
+	if err := writePreamble(df, store, c); err != nil {
+		df.Close()
+		return nil, fmt.Errorf("error writing preamble of datafile %d: %w", id, err)
+	}
+	return df, nil
+}
+
+func writePreamble(df *datafile.DataFile, store storeID, c Checksum) error {
+	p := preamble{Version: formatVersion, Kind: fileKindData, Checksum: c, Created: time.Now(), Store: store}
+	_, err := df.Write(p.encode())
+	return err
+}
+
+// checkDataFiles checks the preambles of the existing datafiles and returns the id of
+// the store they belong to, or a new one if there are none. The checksum algorithm of
+// the options is settled against the one of the datafiles. A datafile too short to hold
+// a preamble is only accepted as the last one, where it was torn while being created
+// and is given a fresh preamble unless the store is opened read-only.
+func checkDataFiles(dir string, dfs map[int]*datafile.DataFile, last int, opts *Options) (storeID, error) {
+	var (
+		store storeID
+		sum   Checksum
+		known bool
+	)
+	for id, df := range dfs {
+		path := filepath.Join(dir, fmt.Sprintf(datafile.ACTIVE_DATAFILE, id))
+		size, err := df.Size()
+		if err != nil {
+			return store, err
+		}
+		if size < preambleSize {
+			if size == 0 {
+				continue
+			}
+			// Only the start of a preamble made it to disk
+			data, err := df.Read(size, int(size))
+			if err != nil {
+				return store, fmt.Errorf("error reading preamble of datafile %d: %w", id, err)
+			}
+			if id != last || !bytes.HasPrefix(data, fileMagic[:min(int(size), len(fileMagic))]) {
+				return store, &FormatError{Path: path, Reason: "too short to hold a preamble"}
+			}
+			continue
+		}
+
+		data, err := df.Read(preambleSize, preambleSize)
+		if err != nil {
+			return store, fmt.Errorf("error reading preamble of datafile %d: %w", id, err)
+		}
+		p, err := decodePreamble(data)
+		switch {
+		case errors.Is(err, errNoPreamble):
+			return store, &FormatError{Path: path, Version: 0, Reason: "legacy format without a preamble, upgrade it with Migrate or bitcaspy migrate"}
+		case err != nil:
+			return store, &FormatError{Path: path, Reason: err.Error()}
+		case p.Kind != fileKindData:
+			return store, &FormatError{Path: path, Version: int(p.Version), Reason: "not a datafile"}
+		case p.Version < formatVersion:
+			return store, &FormatError{Path: path, Version: int(p.Version), Reason: "older format, upgrade it with Migrate or bitcaspy migrate"}
+		case p.Version > formatVersion:
+			return store, &FormatError{Path: path, Version: int(p.Version), Reason: "unknown format version"}
+		case checksumNames[p.Checksum] == "":
+			return store, &FormatError{Path: path, Version: int(p.Version), Reason: "unknown checksum algorithm"}
+		case known && p.Store != store:
+			return store, fmt.Errorf("datafile %s belongs to store %s instead of %s", path, p.Store, store)
+		case known && p.Checksum != sum:
+			return store, fmt.Errorf("datafile %s uses checksum %s instead of %s", path, p.Checksum, sum)
+		}
+		store, sum, known = p.Store, p.Checksum, true
+	}
+	if err := opts.resolveChecksum(sum); err != nil {
+		return store, err
+	}
+
+	if !known {
+		var err error
+		if store, err = newStoreID(); err != nil {
+			return store, fmt.Errorf("error generating store id: %w", err)
+		}
+	}
+
+	// Datafiles without a preamble were empty or torn while being created
+	if opts.readOnly {
+		return store, nil
+	}
+	for _, df := range dfs {
+		if size, err := df.Size(); err != nil || size >= preambleSize {
+			continue
+		}
+		if err := df.Truncate(0); err != nil {
+			return store, err
+		}
+		if err := writePreamble(df, store, opts.checksum); err != nil {
+			return store, err
+		}
+	}
+	return store, nil
+}
@@ -0,0 +1,232 @@
+package bitcasgo
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// groupCommit queues the writes which have to be durable before returning, so that
+// concurrent writers share a single write and fsync of the active datafile.
+// The first writer to find no commit in progress becomes the leader and commits
+// everything queued so far as one group, the others wait to be acknowledged.
+// Once done the leader hands over to a writer which queued in the meantime, so
+// no writer keeps committing the groups of others under a steady stream of writes.
+type groupCommit struct {
+	mu      sync.Mutex
+	pending []*commitRequest
+	leader  bool // A writer is committing the queued requests
+}
+
+// States of a commit request.
+const (
+	requestQueued    int32 = iota
+	requestTaken           // Picked up by the leader, it's committed regardless of the context
+	requestCancelled       // Abandoned by the writer before the leader picked it up
+	requestLeading         // Picked by the leader to commit the next group
+)
+
+type commitRequest struct {
+	op     batchOp // Its value is stored as is, already compressed if flags say so
+	flags  byte
+	expiry *time.Time
+	state  atomic.Int32
+	done   chan error
+}
+
+// commitDurable queues the operation for the next group commit and waits until it's
+// synced to disk. The writer gives up once the context is done, unless the
+// operation is already being committed.
+func (b *BitCaspy) commitDurable(ctx context.Context, op batchOp, expiry *time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	// Values are compressed before queueing, so a record too large even once
+	// compressed is turned down without holding up the group
+	var flags byte
+	if !op.delete {
+		var err error
+		if op.value, flags, err = b.opts.compressValue(op.value); err != nil {
+			return err
+		}
+	}
+	if int64(preambleSize+headerSize+len(op.key)+len(op.value)) > b.opts.maxActiveFileSize {
+		return ErrLargeRecord
+	}
+
+	req := &commitRequest{op: op, flags: flags, expiry: expiry, done: make(chan error, 1)}
+	g := &b.group
+	g.mu.Lock()
+	if g.leader {
+		g.pending = append(g.pending, req)
+		g.mu.Unlock()
+
+		var err error
+		select {
+		case err = <-req.done:
+		case <-ctx.Done():
+			if req.state.CompareAndSwap(requestQueued, requestCancelled) {
+				return ctx.Err()
+			}
+			err = <-req.done
+		}
+		if req.state.Load() != requestLeading {
+			return err
+		}
+		// Leadership was handed over to this writer
+		g.mu.Lock()
+	}
+	g.leader = true
+	queued := g.pending
+	g.pending = nil
+	g.mu.Unlock()
+
+	group := []*commitRequest{req}
+	for _, r := range queued {
+		if r.state.CompareAndSwap(requestQueued, requestTaken) {
+			group = append(group, r)
+		}
+	}
+	b.commitGroup(group)
+
+	// Hand over to the first writer still waiting, if any
+	g.mu.Lock()
+	for len(g.pending) > 0 {
+		next := g.pending[0]
+		g.pending = g.pending[1:]
+		if next.state.CompareAndSwap(requestQueued, requestLeading) {
+			next.done <- nil
+			g.mu.Unlock()
+			return <-req.done
+		}
+	}
+	g.leader = false
+	g.mu.Unlock()
+	return <-req.done
+}
+
+// commitGroup appends the records of the requests to the active datafile in a
+// single write, syncs it once and applies them to the keydir. The records are
+// split across writes only when the active datafile has to be rotated.
+// Every request is acknowledged once its record is durable, or with the error
+// which kept it from being written. A request which fails on its own, such as
+// a record larger than the max file size, doesn't fail the others.
+// Values of the requests are already compressed.
+func (b *BitCaspy) commitGroup(group []*commitRequest) {
+	b.Lock()
+	defer b.Unlock()
+	if b.closed.Load() {
+		for _, req := range group {
+			req.done <- ErrClosed
+		}
+		return
+	}
+
+	buf := b.bufPool.Get().(*bytes.Buffer)
+	defer b.bufPool.Put(buf)
+	defer buf.Reset()
+
+	type pendingKey struct {
+		req    *commitRequest
+		key    string
+		meta   Meta // Location of the record within the buffer
+		delete bool
+	}
+	pending := make([]pendingKey, 0, len(group))
+
+	// flush writes the buffer and syncs it before applying it to the keydir
+	// and acknowledging its requests
+	flush := func() error {
+		if buf.Len() == 0 {
+			return nil
+		}
+		offset, err := b.df.Write(buf.Bytes())
+		if err != nil {
+			return fmt.Errorf("Error writing to the data file: %v", err)
+		}
+		if err := b.df.Sync(); err != nil {
+			return fmt.Errorf("Error syncing the data file: %v", err)
+		}
+		for _, p := range pending {
+			p.meta.fileId = b.df.ID()
+			p.meta.RecordPos += offset
+			if p.delete {
+				b.removeKey(p.key, p.meta)
+			} else {
+				b.setKey(p.key, p.meta)
+			}
+			p.req.done <- nil
+		}
+		buf.Reset()
+		pending = pending[:0]
+		return nil
+	}
+	// abort fails the buffered requests and the ones not written yet once the
+	// datafile can't be written to
+	abort := func(rest []*commitRequest, err error) {
+		for _, p := range pending {
+			p.req.done <- err
+		}
+		for _, req := range rest {
+			req.done <- err
+		}
+	}
+
+	// Whether the keys written by the group exist as of the buffered records
+	exists := make(map[string]bool)
+	for i, req := range group {
+		op := req.op
+		if op.delete {
+			found, ok := exists[op.key]
+			if !ok {
+				_, found = b.KeyDir.Get(op.key)
+			}
+			// Nothing to delete
+			if !found {
+				req.done <- nil
+				continue
+			}
+		}
+
+		size := headerSize + len(op.key) + len(op.value)
+		if int64(preambleSize+size) > b.opts.maxActiveFileSize {
+			req.done <- ErrLargeRecord
+			continue
+		}
+		if b.df.Offset()+int64(buf.Len()+size) > b.opts.maxActiveFileSize {
+			if err := flush(); err != nil {
+				abort(group[i:], err)
+				return
+			}
+		}
+		if err := b.makeRoom(size); err != nil {
+			abort(group[i:], err)
+			return
+		}
+
+		header := b.newTombstoneHeader(op.key)
+		if !op.delete {
+			header = b.newHeader(op.key, op.value, req.flags, req.expiry)
+		}
+		start := buf.Len()
+		encodeRecord(buf, b.opts.checksum, header, op.key, op.value)
+		pending = append(pending, pendingKey{
+			req: req,
+			key: op.key,
+			meta: Meta{
+				RecordSize: buf.Len() - start,
+				RecordPos:  int64(buf.Len()),
+				tstamp:     header.Tstamp,
+				seq:        header.Seq,
+			},
+			delete: op.delete,
+		})
+		exists[op.key] = !op.delete
+	}
+	if err := flush(); err != nil {
+		abort(nil, err)
+	}
+}
@@ -0,0 +1,186 @@
+package bitcasgo
+
+import (
+	"compress/flate"
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestRequest(key, value string) *commitRequest {
+	return &commitRequest{op: batchOp{key: key, value: []byte(value)}, done: make(chan error, 1)}
+}
+
+func TestCommitGroupErrorsPerRequest(t *testing.T) {
+	b, _ := openTest(t, WithMaxFileSize(200))
+	group := []*commitRequest{
+		newTestRequest("good", "v"),
+		newTestRequest("big", strings.Repeat("x", 300)),
+		newTestRequest("other", "v"),
+	}
+	b.commitGroup(group)
+
+	want := []error{nil, ErrLargeRecord, nil}
+	for i, req := range group {
+		if err := <-req.done; !errors.Is(err, want[i]) {
+			t.Errorf("request %q: error = %v, want %v", req.op.key, err, want[i])
+		}
+	}
+	assertGet(t, b, "good", "v")
+	assertGet(t, b, "other", "v")
+	assertErr(t, b, "big", ErrNoKey)
+}
+
+func TestCommitGroupAcrossRotation(t *testing.T) {
+	b, dir := openTest(t, WithMaxFileSize(200))
+	// Every record takes 63 bytes, so the group is split over three datafiles
+	group := make([]*commitRequest, 5)
+	for i := range group {
+		group[i] = newTestRequest(fmt.Sprintf("k%d", i), "12345678901234567890")
+	}
+	b.commitGroup(group)
+	for _, req := range group {
+		if err := <-req.done; err != nil {
+			t.Fatalf("request %q: %v", req.op.key, err)
+		}
+	}
+
+	b.Close()
+	b = reopenTest(t, dir, WithMaxFileSize(200))
+	for i := range group {
+		assertGet(t, b, fmt.Sprintf("k%d", i), "12345678901234567890")
+	}
+}
+
+func TestGroupCommitConcurrentWriters(t *testing.T) {
+	b, dir := openTest(t, WithDurability(SyncGroupCommit), WithMaxFileSize(4096))
+	const writers, writes = 16, 50
+
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < writes; i++ {
+				key := fmt.Sprintf("w%02d-%02d", w, i)
+				if err := b.Put(key, []byte(key)); err != nil {
+					t.Errorf("Put(%q): %v", key, err)
+					return
+				}
+				if i%5 == 0 {
+					if err := b.Delete(key); err != nil {
+						t.Errorf("Delete(%q): %v", key, err)
+						return
+					}
+				}
+			}
+			// A write too large for any datafile only fails on its own
+			if err := b.Put(fmt.Sprintf("big-%d", w), make([]byte, 8192)); !errors.Is(err, ErrLargeRecord) {
+				t.Errorf("Put of a large value: error = %v, want ErrLargeRecord", err)
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	b.group.mu.Lock()
+	leader, pending := b.group.leader, len(b.group.pending)
+	b.group.mu.Unlock()
+	if leader || pending != 0 {
+		t.Fatalf("group commit left with leader %v and %d pending requests", leader, pending)
+	}
+
+	b.Close()
+	b = reopenTest(t, dir, WithMaxFileSize(4096))
+	for w := 0; w < writers; w++ {
+		for i := 0; i < writes; i++ {
+			key := fmt.Sprintf("w%02d-%02d", w, i)
+			if i%5 == 0 {
+				assertErr(t, b, key, ErrNoKey)
+				continue
+			}
+			assertGet(t, b, key, key)
+		}
+	}
+}
+
+func TestGroupCommitCancelledWhileQueued(t *testing.T) {
+	b, _ := openTest(t, WithDurability(SyncGroupCommit))
+
+	// Keep the leader from committing so the next writer has to queue
+	b.Lock()
+	leaderDone := make(chan error, 1)
+	go func() { leaderDone <- b.Put("first", []byte("v")) }()
+	waitGroupCommit(t, b, func(g *groupCommit) bool { return g.leader })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	queuedDone := make(chan error, 1)
+	go func() { queuedDone <- b.PutContext(ctx, "second", []byte("v")) }()
+	waitGroupCommit(t, b, func(g *groupCommit) bool { return len(g.pending) == 1 })
+	cancel()
+	if err := <-queuedDone; !errors.Is(err, context.Canceled) {
+		t.Fatalf("queued Put error = %v, want context.Canceled", err)
+	}
+
+	b.Unlock()
+	if err := <-leaderDone; err != nil {
+		t.Fatalf("leader Put: %v", err)
+	}
+	assertGet(t, b, "first", "v")
+	assertErr(t, b, "second", ErrNoKey)
+}
+
+// waitGroupCommit waits until the state of the group commit satisfies cond.
+func waitGroupCommit(t *testing.T, b *BitCaspy, cond func(g *groupCommit) bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		b.group.mu.Lock()
+		ok := cond(&b.group)
+		b.group.mu.Unlock()
+		if ok {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatal("timed out waiting for the group commit")
+}
+
+func TestGroupCommitLargeCompressedRecord(t *testing.T) {
+	b, _ := openTest(t, WithDurability(SyncGroupCommit), WithMaxFileSize(4096), WithCompression(NewFlateCompressor(flate.BestSpeed), 64))
+
+	// Keep the leader from committing so the next writers have to queue
+	b.Lock()
+	leaderDone := make(chan error, 1)
+	go func() { leaderDone <- b.Put("first", []byte("v")) }()
+	waitGroupCommit(t, b, func(g *groupCommit) bool { return g.leader })
+
+	// Random bytes don't compress, the record is turned down without queueing
+	big := make([]byte, 8192)
+	rand.New(rand.NewSource(1)).Read(big)
+	if err := b.Put("big", big); !errors.Is(err, ErrLargeRecord) {
+		t.Fatalf("Put of an incompressible value: error = %v, want ErrLargeRecord", err)
+	}
+	waitGroupCommit(t, b, func(g *groupCommit) bool { return len(g.pending) == 0 })
+
+	// Whereas a value which compresses small enough joins the group
+	small := strings.Repeat("x", 8192)
+	queuedDone := make(chan error, 1)
+	go func() { queuedDone <- b.Put("compressed", []byte(small)) }()
+	waitGroupCommit(t, b, func(g *groupCommit) bool { return len(g.pending) == 1 })
+
+	b.Unlock()
+	if err := <-leaderDone; err != nil {
+		t.Fatalf("leader Put: %v", err)
+	}
+	if err := <-queuedDone; err != nil {
+		t.Fatalf("Put of a compressible value: %v", err)
+	}
+	assertGet(t, b, "first", "v")
+	assertGet(t, b, "compressed", small)
+	assertErr(t, b, "big", ErrNoKey)
+}
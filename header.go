@@ -3,10 +3,35 @@ package bitcasgo
 import (
 	"bytes"
 	"encoding/binary"
-	"hash/crc32"
+	"io"
 	"time"
 )
 
+// Flags of a record header.
+const (
+	// flagTombstone marks the deletion of the key. Tombstones carry no value.
+	flagTombstone byte = 1 << iota
+	// flagBatchBegin and flagBatchCommit mark the control records around a batch.
+	// Control records have an empty key, which is never allowed for user records,
+	// and their value holds the number of records in the batch.
+	flagBatchBegin
+	flagBatchCommit
+	// flagCompressed marks a value compressed by the compressor whose id is its first byte.
+	flagCompressed
+)
+
+// ctrlValueSize is the size of the value of a control record.
+const ctrlValueSize = 4
+
+// headerSize is the size in bytes of an encoded record header: the checksum, timestamp,
+// expiry and sequence number as 64 bit integers, the key size and value size as uint32s,
+// all little endian, followed by the flags.
+const headerSize = 8*4 + 4*2 + 1
+
+// checksumSize is the size of the checksum at the start of the header. The checksum
+// covers everything after it up to the end of the value.
+const checksumSize = 8
+
 type Record struct {
 	Header Header
 	Key    string
@@ -14,29 +39,122 @@ type Record struct {
 }
 
 type Header struct {
-	Crc    uint32
-	Tstamp uint32
-	Expiry uint32
+	Crc    uint64 // Checksum of the record, see Checksum
+	Tstamp int64  // Unix time in nanoseconds the record was written at
+	Expiry int64  // Unix time in nanoseconds the record expires at, zero if it never does
+	Seq    uint64 // Store-wide sequence number ordering the writes, zero for control records
 	Ksz    uint32
 	Vsz    uint32
+	Flags  byte
 }
 
 func (h *Header) Encode(buf *bytes.Buffer) error {
-	return binary.Write(buf, binary.LittleEndian, h)
+	var data [headerSize]byte
+	h.put(data[:])
+	_, err := buf.Write(data[:])
+	return err
+}
+
+// put encodes the header into data, which must hold at least headerSize bytes.
+func (h *Header) put(data []byte) {
+	binary.LittleEndian.PutUint64(data[0:], h.Crc)
+	binary.LittleEndian.PutUint64(data[8:], uint64(h.Tstamp))
+	binary.LittleEndian.PutUint64(data[16:], uint64(h.Expiry))
+	binary.LittleEndian.PutUint64(data[24:], h.Seq)
+	binary.LittleEndian.PutUint32(data[32:], h.Ksz)
+	binary.LittleEndian.PutUint32(data[36:], h.Vsz)
+	data[40] = h.Flags
 }
 
 // Decode takes a record object decodes the binary value the buffer.
 func (h *Header) Decode(record []byte) error {
-	return binary.Read(bytes.NewReader(record), binary.LittleEndian, h)
+	if len(record) < headerSize {
+		return io.ErrUnexpectedEOF
+	}
+	h.Crc = binary.LittleEndian.Uint64(record[0:])
+	h.Tstamp = int64(binary.LittleEndian.Uint64(record[8:]))
+	h.Expiry = int64(binary.LittleEndian.Uint64(record[16:]))
+	h.Seq = binary.LittleEndian.Uint64(record[24:])
+	h.Ksz = binary.LittleEndian.Uint32(record[32:])
+	h.Vsz = binary.LittleEndian.Uint32(record[36:])
+	h.Flags = record[40]
+	return nil
+}
+
+// isTombstone reports whether the record marks the deletion of its key.
+func (h *Header) isTombstone() bool {
+	return h.Flags&flagTombstone != 0
+}
+
+// isControl reports whether the record is a control record rather than a key.
+func (h *Header) isControl() bool {
+	return h.Flags&(flagBatchBegin|flagBatchCommit) != 0
+}
+
+// valueSize returns the number of value bytes which follow the key on disk.
+func (h *Header) valueSize() int {
+	return int(h.Vsz)
+}
+
+// newControlRecord builds a control record with the given flag for a batch of count records.
+// Its checksum is set once it's encoded.
+func newControlRecord(flag byte, count int) Record {
+	value := make([]byte, ctrlValueSize)
+	binary.LittleEndian.PutUint32(value, uint32(count))
+	return Record{
+		Header: Header{
+			Tstamp: time.Now().UnixNano(),
+			Vsz:    ctrlValueSize,
+			Flags:  flag,
+		},
+		Value: value,
+	}
+}
+
+// control returns the flag of the control record and the batch size it carries.
+func (r *Record) control(c Checksum) (byte, int, bool) {
+	flag := r.Header.Flags & (flagBatchBegin | flagBatchCommit)
+	if r.Header.Ksz != 0 || len(r.Value) != ctrlValueSize || !r.isValidChecksum(c) {
+		return 0, 0, false
+	}
+	if flag != flagBatchBegin && flag != flagBatchCommit {
+		return 0, 0, false
+	}
+	return flag, int(binary.LittleEndian.Uint32(r.Value)), true
 }
 
 func (r *Record) isExpired() bool {
 	if r.Header.Expiry == 0 {
 		return false
 	}
-	return int64(r.Header.Expiry) < time.Now().Unix()
+	return !time.Now().Before(r.expiresAt())
+}
+
+// expiresAt returns the time at which the record expires.
+func (r *Record) expiresAt() time.Time {
+	return time.Unix(0, r.Header.Expiry)
+}
+
+// validate rejects records which don't match their checksum or are expired.
+// The checksum comes first, the expiry of a corrupt record can't be trusted.
+func (r *Record) validate(c Checksum) error {
+	if !r.isValidChecksum(c) {
+		return ErrChecksumMismatch
+	}
+	if r.isExpired() {
+		return ErrExpiredKey
+	}
+	return nil
+}
+
+func (r *Record) isValidChecksum(c Checksum) bool {
+	return r.checksum(c) == r.Header.Crc
 }
 
-func (r *Record) isValidChecksum() bool {
-	return crc32.ChecksumIEEE(r.Value) == r.Header.Crc
+// checksum computes the checksum of the record over its header fields after the
+// checksum itself, its key and its value.
+func (r *Record) checksum(c Checksum) uint64 {
+	var data [headerSize]byte
+	r.Header.put(data[:])
+	return c.sum(data[checksumSize:], []byte(r.Key), r.Value)
 }
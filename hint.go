@@ -0,0 +1,258 @@
+package bitcasgo
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	datafile "bitcasgo/internal"
+)
+
+// errInvalidHint is returned when a hint file is torn or doesn't match its datafile.
+var errInvalidHint = errors.New("invalid hint file")
+
+// hintHeader is the fixed size part of a hint entry. Following the bitcask paper
+// every entry holds the timestamp, key size, value size and value position
+// followed by the key itself, along with the sequence number and flags of the record.
+type hintHeader struct {
+	Tstamp   int64
+	Seq      uint64
+	Ksz      uint32
+	Vsz      uint32
+	ValuePos uint64
+	Flags    byte
+}
+
+// hintHeaderSize is the size in bytes of an encoded hint header, its fields are
+// encoded in order in little endian.
+const hintHeaderSize = 8*2 + 4*2 + 8 + 1
+
+func (h *hintHeader) encode(buf *bytes.Buffer) {
+	var data [hintHeaderSize]byte
+	binary.LittleEndian.PutUint64(data[0:], uint64(h.Tstamp))
+	binary.LittleEndian.PutUint64(data[8:], h.Seq)
+	binary.LittleEndian.PutUint32(data[16:], h.Ksz)
+	binary.LittleEndian.PutUint32(data[20:], h.Vsz)
+	binary.LittleEndian.PutUint64(data[24:], h.ValuePos)
+	data[32] = h.Flags
+	buf.Write(data[:])
+}
+
+func (h *hintHeader) decode(data []byte) {
+	h.Tstamp = int64(binary.LittleEndian.Uint64(data[0:]))
+	h.Seq = binary.LittleEndian.Uint64(data[8:])
+	h.Ksz = binary.LittleEndian.Uint32(data[16:])
+	h.Vsz = binary.LittleEndian.Uint32(data[20:])
+	h.ValuePos = binary.LittleEndian.Uint64(data[24:])
+	h.Flags = data[32]
+}
+
+// hintSummary follows the preamble of a hint file. It accounts the records of the
+// datafile which are left out of the hint file because a later record of their key
+// in the same datafile superseded them, so its stats are restored without a scan.
+type hintSummary struct {
+	DeadRecords uint64
+	DeadBytes   uint64
+}
+
+// hintSummarySize is the size in bytes of an encoded hint summary, its fields are
+// encoded in order in little endian.
+const hintSummarySize = 8 * 2
+
+func (s *hintSummary) encode(buf *bytes.Buffer) {
+	var data [hintSummarySize]byte
+	binary.LittleEndian.PutUint64(data[0:], s.DeadRecords)
+	binary.LittleEndian.PutUint64(data[8:], s.DeadBytes)
+	buf.Write(data[:])
+}
+
+func (s *hintSummary) decode(data []byte) {
+	s.DeadRecords = binary.LittleEndian.Uint64(data[0:])
+	s.DeadBytes = binary.LittleEndian.Uint64(data[8:])
+}
+
+// add accounts a superseded record.
+func (s *hintSummary) add(recordSize int) {
+	s.DeadRecords++
+	s.DeadBytes += uint64(recordSize)
+}
+
+type hintEntry struct {
+	hintHeader
+	Key string
+}
+
+// isTombstone reports whether the hint points at a deletion of its key.
+func (h hintEntry) isTombstone() bool {
+	return h.Flags&flagTombstone != 0
+}
+
+// valueSize returns the number of value bytes of the record the hint points to.
+func (h hintEntry) valueSize() int {
+	return int(h.Vsz)
+}
+
+// meta returns the keydir entry for the record this hint points to.
+func (h hintEntry) meta(fileId int) Meta {
+	return Meta{
+		fileId:     fileId,
+		RecordSize: headerSize + int(h.Ksz) + h.valueSize(),
+		RecordPos:  int64(h.ValuePos) + int64(h.valueSize()),
+		tstamp:     h.Tstamp,
+		seq:        h.Seq,
+	}
+}
+
+func (b *BitCaspy) hintPath(id int) string {
+	return filepath.Join(b.opts.dir, fmt.Sprintf(HINT_FILE, id))
+}
+
+// writeHintFile scans an immutable datafile and writes the hint file for it.
+// Only the record with the highest sequence number of every key in the datafile
+// is kept, tombstones included, so the hint file can be replayed in place of the datafile.
+// The records left out are accounted in the summary of the hint file.
+func (b *BitCaspy) writeHintFile(df *datafile.DataFile) error {
+	var summary hintSummary
+	latest := make(map[string]hintEntry)
+	err := scanDataFile(df, b.opts.checksum, func(record Record, meta Meta) error {
+		if prev, ok := latest[record.Key]; ok {
+			if prev.Seq > record.Header.Seq {
+				summary.add(meta.RecordSize)
+				return nil
+			}
+			summary.add(prev.meta(df.ID()).RecordSize)
+		}
+		latest[record.Key] = hintEntry{
+			hintHeader: hintHeader{
+				Tstamp:   record.Header.Tstamp,
+				Seq:      record.Header.Seq,
+				Ksz:      record.Header.Ksz,
+				Vsz:      record.Header.Vsz,
+				ValuePos: uint64(meta.RecordPos - int64(record.Header.valueSize())),
+				Flags:    record.Header.Flags,
+			},
+			Key: record.Key,
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errPartialRecord) {
+		return fmt.Errorf("error scanning datafile %d: %w", df.ID(), err)
+	}
+
+	entries := make([]hintEntry, 0, len(latest))
+	for _, entry := range latest {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].ValuePos < entries[j].ValuePos
+	})
+
+	buf := b.bufPool.Get().(*bytes.Buffer)
+	defer b.bufPool.Put(buf)
+	defer buf.Reset()
+
+	p := preamble{Version: formatVersion, Kind: fileKindHint, Checksum: b.opts.checksum, Created: time.Now(), Store: b.storeID}
+	buf.Write(p.encode())
+	summary.encode(buf)
+	for _, entry := range entries {
+		entry.hintHeader.encode(buf)
+		buf.WriteString(entry.Key)
+	}
+	// The trailing checksum lets a torn hint file be detected on load.
+	if err := binary.Write(buf, binary.LittleEndian, crc32.ChecksumIEEE(buf.Bytes())); err != nil {
+		return err
+	}
+
+	return writeFileAtomic(b.hintPath(df.ID()), buf.Bytes())
+}
+
+// readHintFile decodes the hint file of a datafile along with its summary and
+// validates every entry against the size of the datafile.
+func (b *BitCaspy) readHintFile(df *datafile.DataFile) ([]hintEntry, hintSummary, error) {
+	var summary hintSummary
+	data, err := os.ReadFile(b.hintPath(df.ID()))
+	if err != nil {
+		return nil, summary, err
+	}
+	if len(data) < preambleSize+hintSummarySize+4 {
+		return nil, summary, errInvalidHint
+	}
+
+	body, sum := data[:len(data)-4], binary.LittleEndian.Uint32(data[len(data)-4:])
+	if crc32.ChecksumIEEE(body) != sum {
+		return nil, summary, errInvalidHint
+	}
+
+	// Hint files of other versions or stores are rebuilt from their datafile
+	p, err := decodePreamble(body)
+	if err != nil {
+		return nil, summary, fmt.Errorf("%w: %v", errInvalidHint, err)
+	}
+	if p.Version != formatVersion || p.Kind != fileKindHint || p.Store != b.storeID {
+		return nil, summary, fmt.Errorf("%w: version %d of store %s", errInvalidHint, p.Version, p.Store)
+	}
+	summary.decode(body[preambleSize:])
+	body = body[preambleSize+hintSummarySize:]
+
+	size, err := df.Size()
+	if err != nil {
+		return nil, summary, err
+	}
+
+	entries := make([]hintEntry, 0)
+	for len(body) > 0 {
+		if len(body) < hintHeaderSize {
+			return nil, summary, errInvalidHint
+		}
+		var entry hintEntry
+		entry.hintHeader.decode(body)
+		body = body[hintHeaderSize:]
+
+		if uint64(len(body)) < uint64(entry.Ksz) {
+			return nil, summary, errInvalidHint
+		}
+		entry.Key = string(body[:entry.Ksz])
+		body = body[entry.Ksz:]
+
+		// The record the hint points to must lie within the datafile.
+		recordStart := int64(entry.ValuePos) - int64(entry.Ksz) - int64(headerSize)
+		if recordStart < preambleSize || int64(entry.ValuePos)+int64(entry.valueSize()) > size {
+			return nil, summary, errInvalidHint
+		}
+		entries = append(entries, entry)
+	}
+	return entries, summary, nil
+}
+
+// genrateHintFiles writes a hint file for every immutable datafile which doesn't have one yet.
+// It's serialised with merges so that no hint file is written for a datafile being removed.
+func (b *BitCaspy) genrateHintFiles() error {
+	b.mergeMu.Lock()
+	defer b.mergeMu.Unlock()
+
+	b.RLock()
+	if b.closed.Load() {
+		b.RUnlock()
+		return ErrClosed
+	}
+	pending := make([]*datafile.DataFile, 0)
+	for id, df := range b.stale {
+		if !exists(b.hintPath(id)) {
+			pending = append(pending, df)
+		}
+	}
+	b.RUnlock()
+
+	for _, df := range pending {
+		if err := b.writeHintFile(df); err != nil {
+			return fmt.Errorf("error writing hint file for datafile %d: %w", df.ID(), err)
+		}
+	}
+	return nil
+}
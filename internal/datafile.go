@@ -18,7 +18,7 @@ type DataFile struct {
 	reader *os.File
 	id     int
 
-	offset int
+	offset int64
 }
 
 // New initializes a new DataFile for storing the data in the database
@@ -47,7 +47,7 @@ func New(dir string, index int) (*DataFile, error) {
 		writer: writer,
 		reader: reader,
 		id:     index,
-		offset: int(stat.Size()),
+		offset: stat.Size(),
 	}
 	return df, nil
 }
@@ -65,8 +65,14 @@ func (d *DataFile) Size() (int64, error) {
 	return stat.Size(), nil
 }
 
-func (d *DataFile) Read(pos int, size int) ([]byte, error) {
-	start := int64(pos - size)
+// Offset returns the position at which the next write is appended.
+func (d *DataFile) Offset() int64 {
+	return d.offset
+}
+
+// Read reads the size bytes which end at pos.
+func (d *DataFile) Read(pos int64, size int) ([]byte, error) {
+	start := pos - int64(size)
 
 	record := make([]byte, size)
 
@@ -82,18 +88,32 @@ func (d *DataFile) Read(pos int, size int) ([]byte, error) {
 	return record, nil
 }
 
-func (d *DataFile) Write(data []byte) (int, error) {
+// Write appends the data and returns the offset it was written at.
+func (d *DataFile) Write(data []byte) (int64, error) {
 	if _, err := d.writer.Write(data); err != nil {
 		return 0, err
 	}
 
 	offset := d.offset
 
-	d.offset += len(data)
+	d.offset += int64(len(data))
 
 	return offset, nil
 }
 
+// Truncate cuts the datafile down to the given size and syncs it, so the next
+// write is appended right after it.
+func (d *DataFile) Truncate(size int64) error {
+	if err := d.writer.Truncate(size); err != nil {
+		return err
+	}
+	if err := d.writer.Sync(); err != nil {
+		return err
+	}
+	d.offset = size
+	return nil
+}
+
 func (d *DataFile) Close() error {
 	if err := d.writer.Close(); err != nil {
 		return err
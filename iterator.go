@@ -0,0 +1,170 @@
+package bitcasgo
+
+import "context"
+
+// iteratorBatchSize is the number of keys an iterator loads from the keydir at once.
+const iteratorBatchSize = 64
+
+// IteratorOptions configures the keys visited by an Iterator.
+type IteratorOptions struct {
+	Prefix   string // Only visit keys with this prefix.
+	Reverse  bool   // Visit keys in descending order.
+	KeysOnly bool   // Only visit keys, Value is not allowed and no datafile is read.
+}
+
+// Iterator walks the keys of the database in order over a consistent snapshot
+// which is unaffected by writes or compaction happening after it was created.
+// An Iterator is not safe for concurrent use and must be closed once done.
+type Iterator struct {
+	snap *snapshot
+	opts IteratorOptions
+	b    *BitCaspy
+	ctx  context.Context
+
+	entries []iteratorEntry // Keys loaded from the keydir
+	pos     int
+	lo, hi  string // Bounds of the keys not loaded yet, an empty hi has no bound
+	done    bool   // No keys are left to load
+	err     error  // Why the iterator stopped early
+}
+
+type iteratorEntry struct {
+	key  string
+	meta Meta
+}
+
+// NewIterator returns an iterator positioned at the first key. The iterator
+// is never valid if the database is closed, and Err reports ErrClosed.
+func (b *BitCaspy) NewIterator(opts IteratorOptions) *Iterator {
+	return b.NewIteratorContext(context.Background(), opts)
+}
+
+// NewIteratorContext is like NewIterator but the iterator stops once the context
+// is done, after which Err reports the error of the context.
+func (b *BitCaspy) NewIteratorContext(ctx context.Context, opts IteratorOptions) *Iterator {
+	if err := b.rLockContext(ctx); err != nil {
+		return &Iterator{opts: opts, b: b, ctx: ctx, err: err}
+	}
+	if b.closed.Load() {
+		b.RUnlock()
+		return &Iterator{opts: opts, b: b, ctx: ctx, err: ErrClosed}
+	}
+	snap := b.newSnapshot()
+	b.RUnlock()
+
+	it := &Iterator{
+		snap: snap,
+		opts: opts,
+		b:    b,
+		ctx:  ctx,
+	}
+	it.Seek("")
+	return it
+}
+
+// Seek moves the iterator to the first key greater than or equal to key,
+// or the last key less than or equal to key when iterating in reverse.
+// An empty key moves the iterator back to the first key.
+func (it *Iterator) Seek(key string) {
+	it.lo, it.hi = it.opts.Prefix, prefixEnd(it.opts.Prefix)
+	if key != "" {
+		if it.opts.Reverse {
+			// The smallest key after key, so that key itself is included
+			if seekEnd := key + "\x00"; it.hi == "" || seekEnd < it.hi {
+				it.hi = seekEnd
+			}
+		} else if key > it.lo {
+			it.lo = key
+		}
+	}
+	it.entries, it.pos, it.done = it.entries[:0], 0, false
+	it.load()
+}
+
+// Next moves the iterator to the next key.
+func (it *Iterator) Next() {
+	if !it.Valid() {
+		return
+	}
+	if err := it.ctx.Err(); err != nil {
+		it.err = err
+		return
+	}
+	it.pos++
+	if it.pos == len(it.entries) {
+		it.load()
+	}
+}
+
+// Valid reports whether the iterator is positioned at a key.
+func (it *Iterator) Valid() bool {
+	return it.err == nil && it.snap != nil && it.pos < len(it.entries)
+}
+
+// Key returns the key the iterator is positioned at.
+func (it *Iterator) Key() string {
+	if !it.Valid() {
+		return ""
+	}
+	return it.entries[it.pos].key
+}
+
+// Value reads the value of the key the iterator is positioned at. Expired
+// and corrupt records are reported the same way as Get does.
+func (it *Iterator) Value() ([]byte, error) {
+	if it.opts.KeysOnly {
+		return nil, ErrKeysOnly
+	}
+	if it.err != nil {
+		return nil, it.err
+	}
+	if !it.Valid() {
+		return nil, ErrNoKey
+	}
+	record, err := it.snap.read(it.entries[it.pos].key, it.entries[it.pos].meta)
+	if err != nil {
+		return nil, err
+	}
+	if err := record.validate(it.snap.checksum); err != nil {
+		return nil, err
+	}
+	return it.b.opts.decompressValue(record)
+}
+
+// Err returns the error which stopped the iterator early, if any.
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+// Close releases the snapshot held by the iterator.
+func (it *Iterator) Close() {
+	if it.snap == nil {
+		return
+	}
+	it.b.releaseSnapshot(it.snap)
+	it.snap, it.entries = nil, nil
+}
+
+// load fetches the next batch of keys from the snapshot.
+func (it *Iterator) load() {
+	it.entries, it.pos = it.entries[:0], 0
+	if it.done || it.snap == nil {
+		return
+	}
+
+	it.snap.keyDir.Range(it.lo, it.hi, it.opts.Reverse, func(key string, meta Meta) bool {
+		it.entries = append(it.entries, iteratorEntry{key: key, meta: meta})
+		return len(it.entries) < iteratorBatchSize
+	})
+	if len(it.entries) < iteratorBatchSize {
+		it.done = true
+		return
+	}
+
+	last := it.entries[len(it.entries)-1].key
+	if it.opts.Reverse {
+		it.hi = last
+	} else {
+		it.lo = last + "\x00"
+	}
+}
@@ -0,0 +1,164 @@
+package bitcasgo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// iteratorKeys puts more keys than fit in a few batches of the iterator, along with
+// keys whose prefixes end in 0xff bytes. It returns the keys in order.
+func iteratorKeys(t *testing.T, b *BitCaspy) []string {
+	t.Helper()
+	keys := []string{"p\xff\xff1", "p\xff\xff2", "p\xff", "q"}
+	for i := 0; i < 3*iteratorBatchSize+10; i++ {
+		keys = append(keys, fmt.Sprintf("k%03d", i))
+	}
+	for _, k := range keys {
+		mustPut(t, b, k, "v"+k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// expectedKeys returns the keys an iterator visits after seeking to seek.
+func expectedKeys(keys []string, opts IteratorOptions, seek string) []string {
+	want := make([]string, 0)
+	for _, k := range keys {
+		if !strings.HasPrefix(k, opts.Prefix) {
+			continue
+		}
+		if seek != "" && (!opts.Reverse && k < seek || opts.Reverse && k > seek) {
+			continue
+		}
+		want = append(want, k)
+	}
+	if opts.Reverse {
+		sort.Sort(sort.Reverse(sort.StringSlice(want)))
+	}
+	return want
+}
+
+// iterate collects the keys from the position of the iterator on, checking their values.
+func iterate(t *testing.T, it *Iterator) []string {
+	t.Helper()
+	keys := make([]string, 0)
+	for ; it.Valid(); it.Next() {
+		keys = append(keys, it.Key())
+		if it.opts.KeysOnly {
+			continue
+		}
+		v, err := it.Value()
+		if err != nil {
+			t.Fatalf("Value(%q): %v", it.Key(), err)
+		}
+		if string(v) != "v"+it.Key() {
+			t.Fatalf("Value(%q) = %q", it.Key(), v)
+		}
+	}
+	if err := it.Err(); err != nil {
+		t.Fatalf("Err: %v", err)
+	}
+	return keys
+}
+
+func TestIterator(t *testing.T) {
+	b, _ := openTest(t)
+	keys := iteratorKeys(t, b)
+
+	for _, opts := range []IteratorOptions{
+		{},
+		{Reverse: true},
+		{KeysOnly: true},
+		{Prefix: "k1"},
+		{Prefix: "k1", Reverse: true},
+		{Prefix: "p\xff"},
+		{Prefix: "p\xff", Reverse: true},
+		{Prefix: "p\xff\xff", KeysOnly: true},
+		{Prefix: "none"},
+	} {
+		t.Run(fmt.Sprintf("prefix=%q,reverse=%v,keysonly=%v", opts.Prefix, opts.Reverse, opts.KeysOnly), func(t *testing.T) {
+			it := b.NewIterator(opts)
+			defer it.Close()
+			want := expectedKeys(keys, opts, "")
+			if got := iterate(t, it); strings.Join(got, ",") != strings.Join(want, ",") {
+				t.Fatalf("visited %q, want %q", got, want)
+			}
+
+			// Seeking at, between and around batch boundaries and the keys
+			for _, seek := range []string{
+				"k064", "k0645", "k128", "k1", "k199", "k", "a", "z", "p\xff", "p\xff\xff15", "",
+			} {
+				it.Seek(seek)
+				want := expectedKeys(keys, opts, seek)
+				if got := iterate(t, it); strings.Join(got, ",") != strings.Join(want, ",") {
+					t.Fatalf("after Seek(%q) visited %q, want %q", seek, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestIteratorSnapshot(t *testing.T) {
+	b, _ := openTest(t, WithMaxFileSize(4096))
+	keys := iteratorKeys(t, b)
+
+	it := b.NewIterator(IteratorOptions{})
+	defer it.Close()
+
+	// Writes and merges after the iterator was created don't show up
+	mustPut(t, b, "k000", "changed", "k0005", "new")
+	if err := b.Delete(keys[len(keys)-1]); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.RotateActiveFile(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Merge(context.Background()); err != nil {
+		t.Fatalf("Merge: %v", err)
+	}
+	if got := iterate(t, it); strings.Join(got, ",") != strings.Join(keys, ",") {
+		t.Fatalf("visited %q, want %q", got, keys)
+	}
+
+	// Whereas a new iterator sees them
+	it2 := b.NewIterator(IteratorOptions{KeysOnly: true, Prefix: "k000"})
+	defer it2.Close()
+	if got := strings.Join(iterate(t, it2), ","); got != "k000,k0005" {
+		t.Fatalf("new iterator visited %s, want k000,k0005", got)
+	}
+}
+
+func TestIteratorErrors(t *testing.T) {
+	b, _ := openTest(t)
+	iteratorKeys(t, b)
+
+	it := b.NewIterator(IteratorOptions{KeysOnly: true})
+	if _, err := it.Value(); !errors.Is(err, ErrKeysOnly) {
+		t.Fatalf("Value of a keys only iterator: error = %v, want ErrKeysOnly", err)
+	}
+	it.Close()
+	if it.Valid() {
+		t.Fatal("closed iterator is valid")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	it = b.NewIteratorContext(ctx, IteratorOptions{})
+	defer it.Close()
+	it.Next()
+	cancel()
+	it.Next()
+	if it.Valid() || !errors.Is(it.Err(), context.Canceled) {
+		t.Fatalf("iterator after cancel: valid %v, error %v", it.Valid(), it.Err())
+	}
+
+	b.Close()
+	it = b.NewIterator(IteratorOptions{})
+	defer it.Close()
+	if it.Valid() || !errors.Is(it.Err(), ErrClosed) {
+		t.Fatalf("iterator of a closed database: valid %v, error %v", it.Valid(), it.Err())
+	}
+}
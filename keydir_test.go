@@ -0,0 +1,190 @@
+package bitcasgo
+
+import (
+	"math/rand"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// keyDirModel is a sorted map the keydir is checked against.
+type keyDirModel map[string]Meta
+
+// rangeKeys returns the keys of the model in [start, end), an empty end having no bound.
+func (m keyDirModel) rangeKeys(start, end string, reverse bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		if k >= start && (end == "" || k < end) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	if reverse {
+		for i, j := 0, len(keys)-1; i < j; i, j = i+1, j-1 {
+			keys[i], keys[j] = keys[j], keys[i]
+		}
+	}
+	return keys
+}
+
+func (m keyDirModel) clone() keyDirModel {
+	c := make(keyDirModel, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
+
+// randomKey returns a short key over a small alphabet holding 0xff bytes, so keys
+// share prefixes and prefixEnd has to carry over them.
+func randomKey(r *rand.Rand) string {
+	const alphabet = "ab\xff"
+	key := make([]byte, 1+r.Intn(4))
+	for i := range key {
+		key[i] = alphabet[r.Intn(len(alphabet))]
+	}
+	return string(key)
+}
+
+// checkKeyDir compares every way of reading the keydir with the model.
+func checkKeyDir(t *testing.T, r *rand.Rand, kd KeyDir, m keyDirModel) {
+	t.Helper()
+	if kd.Len() != len(m) {
+		t.Fatalf("Len = %d, want %d", kd.Len(), len(m))
+	}
+	for k, want := range m {
+		if got, ok := kd.Get(k); !ok || got != want {
+			t.Fatalf("Get(%q) = %v, %v, want %v", k, got, ok, want)
+		}
+	}
+	if _, ok := kd.Get("missing"); ok {
+		t.Fatal("Get of a missing key found it")
+	}
+
+	collect := func(walk func(fn func(key string, meta Meta) bool), limit int) []string {
+		keys := make([]string, 0)
+		walk(func(key string, meta Meta) bool {
+			if meta != m[key] {
+				t.Fatalf("%q has meta %v, want %v", key, meta, m[key])
+			}
+			keys = append(keys, key)
+			return len(keys) != limit
+		})
+		return keys
+	}
+	for _, reverse := range []bool{false, true} {
+		for i := 0; i < 10; i++ {
+			start, end := randomKey(r), randomKey(r)
+			switch r.Intn(3) {
+			case 0:
+				start = ""
+			case 1:
+				end = ""
+			}
+			want := m.rangeKeys(start, end, reverse)
+			got := collect(func(fn func(string, Meta) bool) { kd.Range(start, end, reverse, fn) }, -1)
+			if strings.Join(got, ",") != strings.Join(want, ",") {
+				t.Fatalf("Range(%q, %q, %v) = %q, want %q", start, end, reverse, got, want)
+			}
+			// Stopping early
+			if limit := 1 + r.Intn(3); len(want) > limit {
+				got := collect(func(fn func(string, Meta) bool) { kd.Range(start, end, reverse, fn) }, limit)
+				if strings.Join(got, ",") != strings.Join(want[:limit], ",") {
+					t.Fatalf("Range(%q, %q, %v) stopped after %d = %q, want %q", start, end, reverse, limit, got, want[:limit])
+				}
+			}
+
+			prefix := randomKey(r)
+			prefix = prefix[:min(len(prefix), 2)]
+			want = want[:0]
+			for _, k := range m.rangeKeys("", "", reverse) {
+				if strings.HasPrefix(k, prefix) {
+					want = append(want, k)
+				}
+			}
+			got = collect(func(fn func(string, Meta) bool) { kd.Scan(prefix, reverse, fn) }, -1)
+			if strings.Join(got, ",") != strings.Join(want, ",") {
+				t.Fatalf("Scan(%q, %v) = %q, want %q", prefix, reverse, got, want)
+			}
+		}
+	}
+}
+
+func TestKeyDirRandomized(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	kd, m := NewKeyDir(), keyDirModel{}
+
+	type snapshot struct {
+		kd KeyDir
+		m  keyDirModel
+	}
+	var snaps []snapshot
+	for i := 0; i < 2000; i++ {
+		key := randomKey(r)
+		if r.Intn(3) == 0 {
+			kd.Delete(key)
+			delete(m, key)
+		} else {
+			meta := Meta{fileId: r.Intn(4), RecordPos: int64(i), seq: uint64(i)}
+			kd.Put(key, meta)
+			m[key] = meta
+		}
+		if i%100 == 0 {
+			checkKeyDir(t, r, kd, m)
+			snaps = append(snaps, snapshot{kd: kd.Snapshot(), m: m.clone()})
+		}
+	}
+	checkKeyDir(t, r, kd, m)
+
+	// Snapshots are unaffected by the writes made after them
+	for _, s := range snaps {
+		checkKeyDir(t, r, s.kd, s.m)
+	}
+
+	// Nor is the keydir affected by writes to a snapshot
+	s := kd.Snapshot()
+	s.Put("new", Meta{})
+	s.Delete(m.rangeKeys("", "", false)[0])
+	checkKeyDir(t, r, kd, m)
+}
+
+func TestKeyDirRangeWhileWriting(t *testing.T) {
+	kd := NewKeyDir()
+	for _, k := range []string{"a", "b", "c", "d"} {
+		kd.Put(k, Meta{})
+	}
+	// Range walks the keydir as it was, writes made meanwhile don't show up
+	var keys []string
+	kd.Range("", "", false, func(key string, _ Meta) bool {
+		keys = append(keys, key)
+		kd.Delete("c")
+		kd.Put("bb", Meta{})
+		return true
+	})
+	if got := strings.Join(keys, ","); got != "a,b,c,d" {
+		t.Fatalf("Range visited %s, want a,b,c,d", got)
+	}
+	if _, ok := kd.Get("c"); ok || kd.Len() != 4 {
+		t.Fatalf("writes made while ranging were lost")
+	}
+}
+
+func TestPrefixEnd(t *testing.T) {
+	for _, tc := range []struct {
+		prefix, want string
+	}{
+		{"", ""},
+		{"a", "b"},
+		{"ab", "ac"},
+		{"a\xff", "b"},
+		{"a\xff\xff", "b"},
+		{"ab\xff", "ac"},
+		{"\xff", ""},
+		{"\xff\xff", ""},
+		{"\x00", "\x01"},
+	} {
+		if got := prefixEnd(tc.prefix); got != tc.want {
+			t.Errorf("prefixEnd(%q) = %q, want %q", tc.prefix, got, tc.want)
+		}
+	}
+}
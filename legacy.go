@@ -0,0 +1,204 @@
+package bitcasgo
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"time"
+
+	datafile "bitcasgo/internal"
+)
+
+// legacyLayout describes the records of an older format version which Migrate reads.
+// Older versions checksum the value alone with CRC-32 IEEE.
+type legacyLayout struct {
+	start      int64 // Offset of the first record
+	headerSize int
+	// decode converts a header into the current one, leaving the sequence number unset
+	// for versions without one
+	decode func(data []byte) Header
+	// control returns the flag of a control record and the batch size it carries
+	control func(record Record) (byte, int, bool)
+}
+
+var legacyLayouts = map[int]legacyLayout{
+	// Version 0 has no preamble. Its header holds the checksum, timestamp, expiry,
+	// key size and value size as little endian uint32s. Tombstones are marked with
+	// the largest value size and control records carry their kind in the first byte
+	// of their value, 1 for the start of a batch and 2 for its commit.
+	// The first release had neither and wrote deletes as records with an empty value,
+	// which can't be told apart from putting an empty value. Migrate keeps them as
+	// empty values unless WithLegacyDeletes is set.
+	0: {
+		start:      0,
+		headerSize: 4 * 5,
+		decode: func(data []byte) Header {
+			header := Header{
+				Crc:    uint64(binary.LittleEndian.Uint32(data[0:])),
+				Tstamp: legacyTime(binary.LittleEndian.Uint32(data[4:])),
+				Expiry: legacyTime(binary.LittleEndian.Uint32(data[8:])),
+				Ksz:    binary.LittleEndian.Uint32(data[12:]),
+				Vsz:    binary.LittleEndian.Uint32(data[16:]),
+			}
+			if header.Vsz == ^uint32(0) {
+				header.Vsz, header.Flags = 0, flagTombstone
+			}
+			return header
+		},
+		control: func(record Record) (byte, int, bool) {
+			if len(record.Value) != 5 {
+				return 0, 0, false
+			}
+			count := int(binary.LittleEndian.Uint32(record.Value[1:]))
+			switch record.Value[0] {
+			case 1:
+				return flagBatchBegin, count, true
+			case 2:
+				return flagBatchCommit, count, true
+			}
+			return 0, 0, false
+		},
+	},
+	// Version 1 adds the preamble and a flags byte after the fields of version 0.
+	1: {
+		start:      preambleSize,
+		headerSize: 4*5 + 1,
+		decode: func(data []byte) Header {
+			return Header{
+				Crc:    uint64(binary.LittleEndian.Uint32(data[0:])),
+				Tstamp: legacyTime(binary.LittleEndian.Uint32(data[4:])),
+				Expiry: legacyTime(binary.LittleEndian.Uint32(data[8:])),
+				Ksz:    binary.LittleEndian.Uint32(data[12:]),
+				Vsz:    binary.LittleEndian.Uint32(data[16:]),
+				Flags:  data[20],
+			}
+		},
+		control: batchControl,
+	},
+	// Version 2 widens the timestamp and expiry to unix nanoseconds and adds the
+	// sequence number after them.
+	2: {
+		start:      preambleSize,
+		headerSize: 4 + 8*3 + 4*2 + 1,
+		decode: func(data []byte) Header {
+			return Header{
+				Crc:    uint64(binary.LittleEndian.Uint32(data[0:])),
+				Tstamp: int64(binary.LittleEndian.Uint64(data[4:])),
+				Expiry: int64(binary.LittleEndian.Uint64(data[12:])),
+				Seq:    binary.LittleEndian.Uint64(data[20:]),
+				Ksz:    binary.LittleEndian.Uint32(data[28:]),
+				Vsz:    binary.LittleEndian.Uint32(data[32:]),
+				Flags:  data[36],
+			}
+		},
+		control: batchControl,
+	},
+}
+
+// batchControl reads the control records of versions 1 and 2, which hold the batch size as their value.
+func batchControl(record Record) (byte, int, bool) {
+	flag := record.Header.Flags & (flagBatchBegin | flagBatchCommit)
+	if len(record.Value) != 4 || (flag != flagBatchBegin && flag != flagBatchCommit) {
+		return 0, 0, false
+	}
+	return flag, int(binary.LittleEndian.Uint32(record.Value)), true
+}
+
+// legacyTime converts a timestamp in unix seconds to unix nanoseconds, keeping zero as is.
+func legacyTime(sec uint32) int64 {
+	if sec == 0 {
+		return 0
+	}
+	return time.Unix(int64(sec), 0).UnixNano()
+}
+
+// scanLegacyDataFile walks the records of a datafile in an older format version,
+// verifying their checksums, and calls fn with each of them converted to the current
+// format. Records of a batch are only passed on once it's committed. It returns the
+// size of the intact start of the datafile in the same manner as scanRecords.
+func scanLegacyDataFile(df *datafile.DataFile, version int, fn func(record Record) error) (int64, error) {
+	layout, ok := legacyLayouts[version]
+	if !ok {
+		return 0, fmt.Errorf("%w: no reader for format version %d", ErrUnsupportedFormat, version)
+	}
+	size, err := df.Size()
+	if err != nil {
+		return 0, err
+	}
+	if size < layout.start {
+		return size, nil
+	}
+
+	var (
+		pending []Record // Records of the batch being read
+		inBatch bool
+	)
+	offset, intact := layout.start, layout.start
+	for offset < size {
+		if offset+int64(layout.headerSize) > size {
+			return intact, errPartialRecord
+		}
+		data, err := df.Read(offset+int64(layout.headerSize), layout.headerSize)
+		if err != nil {
+			return intact, fmt.Errorf("error reading header at offset %d: %w", offset, err)
+		}
+		header := layout.decode(data)
+
+		recordSize := int64(layout.headerSize) + int64(header.Ksz) + int64(header.valueSize())
+		if offset+recordSize > size {
+			return intact, errPartialRecord
+		}
+		data, err = df.Read(offset+recordSize, int(recordSize))
+		if err != nil {
+			return intact, fmt.Errorf("error reading record at offset %d: %w", offset, err)
+		}
+		record := Record{
+			Header: header,
+			Key:    string(data[layout.headerSize : layout.headerSize+int(header.Ksz)]),
+			Value:  data[layout.headerSize+int(header.Ksz):],
+		}
+		if uint64(crc32.ChecksumIEEE(record.Value)) != header.Crc {
+			return intact, fmt.Errorf("%w: checksum mismatch at offset %d", errCorruptRecord, offset)
+		}
+		start := offset
+		offset += recordSize
+
+		// Control records have an empty key
+		if header.Ksz == 0 {
+			kind, count, ok := layout.control(record)
+			if !ok {
+				return intact, fmt.Errorf("%w: invalid control record at offset %d", errCorruptBatch, start)
+			}
+			switch kind {
+			case flagBatchBegin:
+				pending, inBatch = pending[:0], true
+			case flagBatchCommit:
+				if !inBatch || count != len(pending) {
+					return intact, fmt.Errorf("%w: unexpected commit at offset %d", errCorruptBatch, start)
+				}
+				for _, r := range pending {
+					if err := fn(r); err != nil {
+						return intact, err
+					}
+				}
+				pending, inBatch = pending[:0], false
+				intact = offset
+			}
+			continue
+		}
+
+		if inBatch {
+			pending = append(pending, record)
+			continue
+		}
+		if err := fn(record); err != nil {
+			return intact, err
+		}
+		intact = offset
+	}
+
+	if inBatch {
+		return intact, errPartialRecord
+	}
+	return intact, nil
+}
@@ -0,0 +1,438 @@
+package bitcasgo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	datafile "bitcasgo/internal"
+)
+
+// MergeResult describes the outcome of a merge.
+type MergeResult struct {
+	FilesMerged    int   // Datafiles merged and removed
+	FilesWritten   int   // Datafiles written with the merged records
+	KeysCopied     int   // Live keys copied to the merged datafiles
+	BytesReclaimed int64 // Disk space freed by the merge
+}
+
+// MergeProgress is reported to the function set with WithMergeProgress
+// every time a merge is done copying a datafile.
+type MergeProgress struct {
+	FilesDone  int   // Datafiles copied so far
+	FilesTotal int   // Datafiles being merged
+	BytesDone  int64 // Bytes of the datafiles copied so far
+	BytesTotal int64 // Bytes of all the datafiles being merged
+}
+
+// Merge compacts every immutable datafile right away, regardless of the merge policy
+// and window. Cancelling the context aborts the merge and leaves the datafiles untouched.
+func (b *BitCaspy) Merge(ctx context.Context) (MergeResult, error) {
+	if b.opts.readOnly {
+		return MergeResult{}, ErrReadOnly
+	}
+
+	b.mergeMu.Lock()
+	defer b.mergeMu.Unlock()
+
+	b.RLock()
+	if b.closed.Load() {
+		b.RUnlock()
+		return MergeResult{}, ErrClosed
+	}
+	ids := make([]int, 0, len(b.stale))
+	for id := range b.stale {
+		ids = append(ids, id)
+	}
+	b.RUnlock()
+
+	return b.mergeFiles(ctx, ids)
+}
+
+// CompactRange compacts the immutable datafiles with ids from start up to and including end,
+// in the same manner as Merge.
+func (b *BitCaspy) CompactRange(ctx context.Context, start, end int) (MergeResult, error) {
+	if b.opts.readOnly {
+		return MergeResult{}, ErrReadOnly
+	}
+
+	b.mergeMu.Lock()
+	defer b.mergeMu.Unlock()
+
+	b.RLock()
+	if b.closed.Load() {
+		b.RUnlock()
+		return MergeResult{}, ErrClosed
+	}
+	ids := make([]int, 0)
+	for id := range b.stale {
+		if id >= start && id <= end {
+			ids = append(ids, id)
+		}
+	}
+	b.RUnlock()
+
+	return b.mergeFiles(ctx, ids)
+}
+
+// merge compacts the immutable datafiles picked by the merge policy into new
+// datafiles holding only their live records.
+func (b *BitCaspy) merge() error {
+	if !b.opts.inMergeWindow(time.Now()) {
+		return nil
+	}
+
+	b.mergeMu.Lock()
+	defer b.mergeMu.Unlock()
+
+	b.RLock()
+	ids := b.mergeCandidates()
+	b.RUnlock()
+
+	res, err := b.mergeFiles(b.ctx, ids)
+	// A merge aborted by Close isn't an error
+	if errors.Is(err, context.Canceled) || errors.Is(err, ErrClosed) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if res.FilesMerged > 0 {
+		b.lo.Info("Merged datafiles", "merged", res.FilesMerged, "written", res.FilesWritten, "reclaimed", res.BytesReclaimed)
+	}
+	return nil
+}
+
+// recordMove is a record copied by a merge from an input to an output datafile.
+type recordMove struct {
+	key       string
+	from, to  Meta
+	tombstone bool
+}
+
+// mergeFiles copies the live records of the given immutable datafiles into new
+// datafiles and removes the inputs. The caller must hold mergeMu.
+//
+// The merged datafiles get fresh ids which sort after every input but before the
+// active datafile, so replaying the datafiles in order of their ids still yields
+// the latest record of every key. The inputs are only removed once the merged
+// datafiles and their hint files are synced and the keydir points to them,
+// which leaves a valid database behind if the process dies at any point.
+//
+// Reads and writes carry on while the records are copied. The lock is only held
+// to set the merge up and to swap the keydir entries at the end, skipping keys
+// which were written to since the merge started.
+func (b *BitCaspy) mergeFiles(ctx context.Context, ids []int) (MergeResult, error) {
+	var res MergeResult
+	if len(ids) == 0 {
+		return res, nil
+	}
+	sort.Ints(ids)
+	inputs := make(map[int]*datafile.DataFile, len(ids))
+
+	// Closing the database aborts the merge as well
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stop := context.AfterFunc(b.ctx, cancel)
+	defer stop()
+
+	b.Lock()
+	if b.closed.Load() {
+		b.Unlock()
+		return res, ErrClosed
+	}
+	for _, id := range ids {
+		df, ok := b.stale[id]
+		if !ok {
+			b.Unlock()
+			return res, fmt.Errorf("error merging datafile %d: not an immutable datafile", id)
+		}
+		inputs[id] = df
+	}
+
+	// Tombstones have to be carried over while an older datafile which isn't
+	// merged may still hold a record of the deleted key.
+	oldestKept := -1
+	for id := range b.stale {
+		if _, ok := inputs[id]; !ok && (oldestKept == -1 || id < oldestKept) {
+			oldestKept = id
+		}
+	}
+
+	// Reserve enough ids after the active datafile for the merged datafiles and move
+	// the active datafile past them, so later writes sort after the merged records.
+	reserved := 0
+	for _, df := range inputs {
+		size, err := df.Size()
+		if err != nil {
+			b.Unlock()
+			return res, err
+		}
+		reserved += b.opts.mergedFilesFor(size)
+	}
+	out := &mergeOutput{
+		b:      b,
+		nextId: b.df.ID() + 1,
+		lastId: b.df.ID() + reserved,
+	}
+	if err := b.rotate(out.lastId + 1); err != nil {
+		b.Unlock()
+		return res, fmt.Errorf("error rotating the active datafile: %w", err)
+	}
+	keyDir := b.KeyDir.Snapshot()
+	b.Unlock()
+
+	moves, err := b.copyLive(ctx, ids, inputs, keyDir, oldestKept, out)
+	if err == nil {
+		err = out.finish()
+	}
+	if err != nil {
+		out.discard()
+		return res, err
+	}
+
+	// The merged datafiles are durable, point the keydir at them unless the keys
+	// were written to in the meantime.
+	b.Lock()
+	for _, df := range out.files {
+		b.stale[df.ID()] = df
+		b.fileStats(df.ID())
+	}
+	for _, m := range moves {
+		if m.tombstone {
+			b.addTombstone(m.to)
+			continue
+		}
+		// The copy is dead from the start if the key was written to in the meantime
+		if cur, ok := b.KeyDir.Get(m.key); ok && cur == m.from {
+			b.setKey(m.key, m.to)
+			res.KeysCopied++
+		} else {
+			b.addDead(m.to)
+		}
+	}
+	for _, id := range ids {
+		delete(b.stale, id)
+		delete(b.stats, id)
+	}
+	b.Unlock()
+
+	res.FilesMerged = len(ids)
+	res.FilesWritten = len(out.files)
+	for _, df := range inputs {
+		if size, err := df.Size(); err == nil {
+			res.BytesReclaimed += size
+		}
+	}
+	for _, df := range out.files {
+		if size, err := df.Size(); err == nil {
+			res.BytesReclaimed -= size
+		}
+	}
+	retired := make([]*datafile.DataFile, 0, len(ids))
+	for _, id := range ids {
+		retired = append(retired, inputs[id])
+	}
+	return res, b.retire(retired)
+}
+
+// copyLive copies the live records and the tombstones which are still needed from the
+// datafiles to the merge output and returns where they were moved to.
+// Records are live if the keydir snapshot taken at the start of the merge points to them.
+// A record failing its checksum aborts the merge, leaving the datafiles as they are.
+func (b *BitCaspy) copyLive(ctx context.Context, ids []int, inputs map[int]*datafile.DataFile, keyDir KeyDir, oldestKept int, out *mergeOutput) ([]recordMove, error) {
+	progress := MergeProgress{FilesTotal: len(ids)}
+	for _, df := range inputs {
+		if size, err := df.Size(); err == nil {
+			progress.BytesTotal += size
+		}
+	}
+
+	moves := make([]recordMove, 0)
+	for _, id := range ids {
+		keepTombstones := oldestKept != -1 && oldestKept < id
+
+		// The records are written with a fresh checksum, so a corrupt one would pass for intact
+		_, err := scanRecords(inputs[id], b.opts.checksum, true, func(record Record, meta Meta) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if record.Header.isTombstone() {
+				// A tombstone is stale once the key was put again
+				if _, ok := keyDir.Get(record.Key); ok || !keepTombstones {
+					return nil
+				}
+				to, err := out.write(record)
+				if err != nil {
+					return err
+				}
+				moves = append(moves, recordMove{key: record.Key, to: to, tombstone: true})
+				return nil
+			}
+
+			if cur, ok := keyDir.Get(record.Key); !ok || cur != meta {
+				return nil
+			}
+			to, err := out.write(record)
+			if err != nil {
+				return err
+			}
+			moves = append(moves, recordMove{key: record.Key, from: meta, to: to})
+			return nil
+		})
+		if errors.Is(err, errPartialRecord) {
+			b.lo.Warn("Ignoring partial record at the end of datafile", "id", id)
+		} else if err != nil {
+			return nil, fmt.Errorf("error merging datafile %d: %w", id, err)
+		}
+
+		progress.FilesDone++
+		if size, err := inputs[id].Size(); err == nil {
+			progress.BytesDone += size
+		}
+		if b.opts.mergeProgress != nil {
+			b.opts.mergeProgress(progress)
+		}
+	}
+	return moves, nil
+}
+
+// mergedFilesFor returns how many merged datafiles the records of an input datafile
+// of the given size can take at most. The records copied by a merge are a subset of
+// the records of its inputs in the same order, and a merged datafile is only full
+// once the next record doesn't fit, so a datafile within the max file size never
+// spills over into more than one merged datafile. Larger ones, written before the
+// max file size was lowered, take at most two merged datafiles for every max file
+// size of records since any two merged datafiles in a row hold more than that.
+func (o *Options) mergedFilesFor(size int64) int {
+	capacity := o.maxActiveFileSize - preambleSize
+	records := size - preambleSize
+	if records <= capacity {
+		return 1
+	}
+	return int(2*records/capacity) + 1
+}
+
+// mergeOutput writes merged records into datafiles with the ids reserved for a merge.
+// A new datafile is started once the current one is full.
+type mergeOutput struct {
+	b      *BitCaspy
+	nextId int
+	lastId int
+	files  []*datafile.DataFile
+}
+
+func (o *mergeOutput) write(record Record) (Meta, error) {
+	df, err := o.current(int64(headerSize + len(record.Key) + len(record.Value)))
+	if err != nil {
+		return Meta{}, err
+	}
+	return o.b.appendRecord(df, record.Header, record.Key, record.Value)
+}
+
+// current returns the datafile which the next record of the given size goes into.
+func (o *mergeOutput) current(size int64) (*datafile.DataFile, error) {
+	if n := len(o.files); n > 0 {
+		df := o.files[n-1]
+		// Records larger than the max file size get a datafile of their own
+		if df.Offset()+size <= o.b.opts.maxActiveFileSize || df.Offset() <= preambleSize {
+			return df, nil
+		}
+	}
+	if o.nextId > o.lastId {
+		return nil, fmt.Errorf("error creating merged datafile: ran out of the ids reserved up to %d", o.lastId)
+	}
+
+	df, err := openDataFile(o.b.opts.dir, o.nextId, o.b.storeID, o.b.opts.checksum)
+	if err != nil {
+		return nil, fmt.Errorf("error creating merged datafile: %w", err)
+	}
+	o.nextId++
+	o.files = append(o.files, df)
+	return df, nil
+}
+
+// finish syncs the merged datafiles and writes their hint files.
+func (o *mergeOutput) finish() error {
+	for _, df := range o.files {
+		if err := df.Sync(); err != nil {
+			return fmt.Errorf("error syncing merged datafile %d: %w", df.ID(), err)
+		}
+		if err := o.b.writeHintFile(df); err != nil {
+			return fmt.Errorf("error writing hint file for merged datafile %d: %w", df.ID(), err)
+		}
+	}
+	return syncDir(o.b.opts.dir)
+}
+
+// discard removes the datafiles of a failed merge so they don't outlive the inputs.
+func (o *mergeOutput) discard() {
+	for _, df := range o.files {
+		if err := o.b.removeDataFile(df); err != nil {
+			o.b.lo.Error("Error removing datafile of failed merge", "id", df.ID(), "error", err)
+		}
+	}
+}
+
+// retire removes merged datafiles once no snapshot can read from them anymore.
+// Snapshots taken after the keydir swap never point into them, so the datafiles
+// are removed right away if no snapshot is open, otherwise by the last one to be released.
+func (b *BitCaspy) retire(dfs []*datafile.DataFile) error {
+	b.retiredMu.Lock()
+	b.retired = append(b.retired, dfs...)
+	sort.Slice(b.retired, func(i, j int) bool {
+		return b.retired[i].ID() < b.retired[j].ID()
+	})
+	b.retiredMu.Unlock()
+
+	if b.snapshots.Load() > 0 {
+		return nil
+	}
+	return b.removeRetired()
+}
+
+// removeRetired removes every retired datafile unless a snapshot was opened meanwhile.
+func (b *BitCaspy) removeRetired() error {
+	b.retiredMu.Lock()
+	defer b.retiredMu.Unlock()
+
+	if b.snapshots.Load() > 0 {
+		return nil
+	}
+	for len(b.retired) > 0 {
+		if err := b.removeNextRetired(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeNextRetired removes the retired datafile with the lowest id and syncs the directory.
+// A merge drops the tombstones of its inputs when no older datafile is kept, so the
+// inputs go oldest first: a crash in between must never leave the record of a key
+// behind without the tombstone which deleted it. The caller must hold retiredMu.
+func (b *BitCaspy) removeNextRetired() error {
+	df := b.retired[0]
+	if err := b.removeDataFile(df); err != nil {
+		return fmt.Errorf("error removing merged datafile %d: %w", df.ID(), err)
+	}
+	b.retired = b.retired[1:]
+	return syncDir(b.opts.dir)
+}
+
+// removeDataFile closes the datafile and deletes it along with its hint file.
+func (b *BitCaspy) removeDataFile(df *datafile.DataFile) error {
+	if err := df.Close(); err != nil {
+		return err
+	}
+	if err := os.Remove(b.dataPath(df.ID())); err != nil {
+		return err
+	}
+	if err := os.Remove(b.hintPath(df.ID())); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
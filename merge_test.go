@@ -0,0 +1,214 @@
+package bitcasgo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestMergeKeepsMaxFileSize(t *testing.T) {
+	b, dir := openTest(t, WithMaxFileSize(200))
+	// Every record takes 63 bytes, so only two fit in a datafile
+	for i := 0; i < 3; i++ {
+		mustPut(t, b, fmt.Sprintf("k%d", i), "12345678901234567890")
+	}
+	if err := b.RotateActiveFile(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Merge(context.Background()); err != nil {
+		t.Fatalf("Merge: %v", err)
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range files {
+		st, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if st.Size() > 200 {
+			t.Errorf("%s is %d bytes, more than the max file size", filepath.Base(path), st.Size())
+		}
+	}
+	for i := 0; i < 3; i++ {
+		assertGet(t, b, fmt.Sprintf("k%d", i), "12345678901234567890")
+	}
+}
+
+func TestMergeConcurrentWritesAndSnapshots(t *testing.T) {
+	b, dir := openTest(t, WithMaxFileSize(1024))
+	const keys = 50
+	for i := 0; i < keys; i++ {
+		mustPut(t, b, fmt.Sprintf("k%02d", i), "v0")
+	}
+
+	// An iterator opened before the merges keeps reading the values it saw
+	it := b.NewIterator(IteratorOptions{})
+	defer it.Close()
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if _, err := b.Merge(context.Background()); err != nil {
+				t.Errorf("Merge: %v", err)
+				return
+			}
+		}
+	}()
+	for round := 1; round <= 20; round++ {
+		for i := 0; i < keys; i++ {
+			mustPut(t, b, fmt.Sprintf("k%02d", i), fmt.Sprintf("v%d", round))
+		}
+		if err := b.Delete(fmt.Sprintf("k%02d", round)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 40; i < keys; i++ {
+		if err := b.Delete(fmt.Sprintf("k%02d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+
+	n := 0
+	for ; it.Valid(); it.Next() {
+		v, err := it.Value()
+		if err != nil {
+			t.Fatalf("Value(%q): %v", it.Key(), err)
+		}
+		if string(v) != "v0" {
+			t.Fatalf("snapshot sees %q = %q, want v0", it.Key(), v)
+		}
+		n++
+	}
+	if n != keys {
+		t.Fatalf("snapshot has %d keys, want %d", n, keys)
+	}
+
+	check := func(b *BitCaspy) {
+		t.Helper()
+		for i := 0; i < keys; i++ {
+			if i == 20 || i >= 40 {
+				assertErr(t, b, fmt.Sprintf("k%02d", i), ErrNoKey)
+				continue
+			}
+			assertGet(t, b, fmt.Sprintf("k%02d", i), "v20")
+		}
+	}
+	check(b)
+	it.Close()
+	b.Close()
+	check(reopenTest(t, dir, WithMaxFileSize(1024)))
+}
+
+func TestMergeCorruptRecord(t *testing.T) {
+	b, dir := openTest(t)
+	mustPut(t, b, "k1", "value1", "k2", "value2")
+	id := b.df.ID()
+	if err := b.RotateActiveFile(); err != nil {
+		t.Fatal(err)
+	}
+	b.Close()
+
+	// Flip a byte of the value of k1
+	editFile(t, b.dataPath(id), func(data []byte) []byte {
+		data[preambleSize+headerSize+len("k1")+2] ^= 'l' ^ 'm'
+		return data
+	})
+
+	b = reopenTest(t, dir)
+	assertErr(t, b, "k1", ErrChecksumMismatch)
+	if _, err := b.Merge(context.Background()); !errors.Is(err, errCorruptRecord) {
+		t.Fatalf("Merge error = %v, want a corrupt record", err)
+	}
+	// The merge didn't give the corrupt record a valid checksum
+	assertErr(t, b, "k1", ErrChecksumMismatch)
+	assertGet(t, b, "k2", "value2")
+	if _, err := os.Stat(b.dataPath(id)); err != nil {
+		t.Fatalf("datafile of the corrupt record is gone: %v", err)
+	}
+}
+
+// copyStore copies the datafiles and hint files of the store as a crash would leave them.
+func copyStore(t *testing.T, dir string) string {
+	t.Helper()
+	dst := t.TempDir()
+	for _, pattern := range []string{"*.db", "*.hint"} {
+		files, err := filepath.Glob(filepath.Join(dir, pattern))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, path := range files {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(dst, filepath.Base(path)), data, 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	return dst
+}
+
+func TestMergeCrashWhileRemovingInputs(t *testing.T) {
+	b, dir := openTest(t)
+	// The record of k is in the older input, its tombstone in the newer one
+	mustPut(t, b, "k", "v")
+	older := b.df.ID()
+	if err := b.RotateActiveFile(); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Delete("k"); err != nil {
+		t.Fatal(err)
+	}
+	mustPut(t, b, "other", "v")
+	newer := b.df.ID()
+	if err := b.RotateActiveFile(); err != nil {
+		t.Fatal(err)
+	}
+
+	// An open snapshot holds on to the inputs once they're merged
+	b.RLock()
+	snap := b.newSnapshot()
+	b.RUnlock()
+	if _, err := b.Merge(context.Background()); err != nil {
+		t.Fatalf("Merge: %v", err)
+	}
+
+	// The process dies right after removing the first input
+	b.retiredMu.Lock()
+	err := b.removeNextRetired()
+	b.retiredMu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	crashed := copyStore(t, dir)
+	b.releaseSnapshot(snap)
+
+	if _, err := os.Stat(filepath.Join(crashed, filepath.Base(b.dataPath(older)))); !os.IsNotExist(err) {
+		t.Fatalf("older input datafile %d wasn't removed first", older)
+	}
+	if _, err := os.Stat(filepath.Join(crashed, filepath.Base(b.dataPath(newer)))); err != nil {
+		t.Fatalf("newer input datafile %d was removed first: %v", newer, err)
+	}
+	// The merge dropped the tombstone of k, which must not come back
+	c := reopenTest(t, crashed)
+	assertErr(t, c, "k", ErrNoKey)
+	assertGet(t, c, "other", "v")
+}
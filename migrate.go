@@ -0,0 +1,339 @@
+package bitcasgo
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+
+	datafile "bitcasgo/internal"
+)
+
+// MigrateReport summarises a migration made by Migrate.
+type MigrateReport struct {
+	FilesRead         int         // Datafiles read from the source directory
+	FilesWritten      int         // Datafiles written to the destination directory
+	Records           int         // Records copied, tombstones included
+	Tombstones        int         // Tombstones copied
+	BytesRead         int64       // Size of the datafiles read
+	BytesWritten      int64       // Size of the datafiles written
+	DiscardedBytes    int64       // Size of the torn or uncommitted tails which were dropped
+	SourceVersions    map[int]int // Number of datafiles read by format version
+	EmptyLegacyValues int         // Empty values of version 0 datafiles, deletes or empty puts, see WithLegacyDeletes
+}
+
+// WithLegacyDeletes makes Migrate read the records with an empty value of version 0
+// datafiles as deletes. The first release wrote deletes that way, so without it the
+// keys deleted in a store written by it come back with an empty value. Puts of an
+// empty value become deletes as well.
+func WithLegacyDeletes() Config {
+	return func(o *Options) error {
+		o.legacyDeletes = true
+		return nil
+	}
+}
+
+// Migrate rewrites the datafiles of the store in srcDir into dstDir in the current
+// format, along with fresh hint files. Every record is checked against its checksum
+// and the migration is aborted on the first mismatch. Torn or uncommitted records at
+// the end of a datafile are dropped the same way Init would. The source directory is
+// left untouched and the destination directory must not hold any datafiles yet.
+// Options such as WithMaxFileSize and WithChecksum apply to the written datafiles,
+// which keep the checksum algorithm of the source by default.
+func Migrate(srcDir, dstDir string, cfg ...Config) (MigrateReport, error) {
+	report := MigrateReport{SourceVersions: make(map[int]int)}
+
+	opts := DefaultOptions()
+	for _, opt := range cfg {
+		if err := opt(opts); err != nil {
+			return report, fmt.Errorf("applying option failed: %w", err)
+		}
+	}
+	opts.dir = dstDir
+	if err := opts.validate(); err != nil {
+		return report, err
+	}
+	if filepath.Clean(srcDir) == filepath.Clean(dstDir) {
+		return report, errors.New("cannot migrate a store into its own directory")
+	}
+
+	srcFiles, err := getDataFiles(srcDir)
+	if err != nil {
+		return report, err
+	}
+	if len(srcFiles) == 0 {
+		return report, fmt.Errorf("no datafiles found in %s", srcDir)
+	}
+	ids, err := getIds(srcFiles)
+	if err != nil {
+		return report, fmt.Errorf("error getting existing ids for %s: %w", srcFiles, err)
+	}
+
+	if err := opts.checkDir(); err != nil {
+		return report, err
+	}
+	if dstFiles, err := getDataFiles(dstDir); err != nil {
+		return report, err
+	} else if len(dstFiles) > 0 {
+		return report, fmt.Errorf("destination %s already holds datafiles", dstDir)
+	}
+
+	// Keep any process from opening either store while it's being migrated
+	srcLock, err := getFLock(filepath.Join(srcDir, LOCKFILE))
+	if err != nil {
+		return report, err
+	}
+	defer destroyFLock(srcLock)
+	dstLock, err := getFLock(filepath.Join(dstDir, LOCKFILE))
+	if err != nil {
+		return report, err
+	}
+	defer destroyFLock(dstLock)
+
+	src := make([]*datafile.DataFile, 0, len(ids))
+	defer func() {
+		for _, df := range src {
+			df.Close()
+		}
+	}()
+	preambles := make(map[int]preamble, len(ids))
+	store, known := storeID{}, false
+	for _, id := range ids {
+		df, err := datafile.New(srcDir, id)
+		if err != nil {
+			return report, fmt.Errorf("Error creating datafile: %v", err)
+		}
+		src = append(src, df)
+
+		p, err := readSourcePreamble(srcDir, df)
+		if err != nil {
+			return report, err
+		}
+		if p.Version != 0 {
+			if known && p.Store != store {
+				return report, fmt.Errorf("datafile %d belongs to store %s instead of %s", id, p.Store, store)
+			}
+			store, known = p.Store, true
+		}
+		preambles[id] = p
+		// The written store keeps the checksum algorithm of the source unless told otherwise
+		if opts.checksum == 0 && p.Version == formatVersion {
+			opts.checksum = p.Checksum
+		}
+	}
+	if !known {
+		if store, err = newStoreID(); err != nil {
+			return report, fmt.Errorf("error generating store id: %w", err)
+		}
+	}
+	if err := opts.resolveChecksum(0); err != nil {
+		return report, err
+	}
+
+	m := &migration{
+		b: &BitCaspy{
+			lo: initLogger(opts.debug),
+			bufPool: sync.Pool{New: func() any {
+				return bytes.NewBuffer([]byte{})
+			}},
+			opts:    opts,
+			storeID: store,
+		},
+		report: &report,
+	}
+	if err := m.run(src, preambles); err != nil {
+		m.cleanup()
+		return report, err
+	}
+	return report, nil
+}
+
+// readSourcePreamble reads the preamble of a datafile being migrated. Datafiles
+// without one are in the legacy format, version 0.
+func readSourcePreamble(dir string, df *datafile.DataFile) (preamble, error) {
+	path := filepath.Join(dir, fmt.Sprintf(datafile.ACTIVE_DATAFILE, df.ID()))
+	size, err := df.Size()
+	if err != nil {
+		return preamble{}, err
+	}
+	if size < preambleSize {
+		// Too short for a preamble, so it's either empty or a legacy datafile
+		data, err := df.Read(size, int(size))
+		if err != nil {
+			return preamble{}, fmt.Errorf("error reading datafile %d: %w", df.ID(), err)
+		}
+		if size > 0 && bytes.HasPrefix(data, fileMagic[:min(int(size), len(fileMagic))]) {
+			// A torn preamble of a datafile which was never written to
+			return preamble{Version: formatVersion}, nil
+		}
+		return preamble{}, nil
+	}
+
+	data, err := df.Read(preambleSize, preambleSize)
+	if err != nil {
+		return preamble{}, fmt.Errorf("error reading preamble of datafile %d: %w", df.ID(), err)
+	}
+	p, err := decodePreamble(data)
+	switch {
+	case errors.Is(err, errNoPreamble):
+		return preamble{}, nil
+	case err != nil:
+		return p, &FormatError{Path: path, Reason: err.Error()}
+	case p.Kind != fileKindData:
+		return p, &FormatError{Path: path, Version: int(p.Version), Reason: "not a datafile"}
+	case p.Version > formatVersion:
+		return p, &FormatError{Path: path, Version: int(p.Version), Reason: "newer than this version can migrate"}
+	case p.Version == formatVersion && checksumNames[p.Checksum] == "":
+		return p, &FormatError{Path: path, Version: int(p.Version), Reason: "unknown checksum algorithm"}
+	}
+	return p, nil
+}
+
+// migration holds the state of the datafiles being written by Migrate.
+type migration struct {
+	b       *BitCaspy // Writes the records, only its logger, buffers, options and store id are set
+	df      *datafile.DataFile
+	written []*datafile.DataFile
+	report  *MigrateReport
+}
+
+func (m *migration) run(src []*datafile.DataFile, preambles map[int]preamble) error {
+	for _, df := range src {
+		p := preambles[df.ID()]
+		version := int(p.Version)
+		size, err := df.Size()
+		if err != nil {
+			return err
+		}
+		m.report.FilesRead++
+		m.report.BytesRead += size
+		m.report.SourceVersions[version]++
+
+		var intact int64
+		if version < formatVersion {
+			intact, err = scanLegacyDataFile(df, version, func(record Record) error {
+				if version == 0 && record.Header.Vsz == 0 && !record.Header.isTombstone() {
+					m.report.EmptyLegacyValues++
+					if m.b.opts.legacyDeletes {
+						record.Header.Flags |= flagTombstone
+					}
+				}
+				return m.copy(record)
+			})
+		} else {
+			intact, err = scanRecords(df, p.Checksum, true, func(record Record, _ Meta) error {
+				return m.copy(record)
+			})
+		}
+		if errors.Is(err, errPartialRecord) && version == formatVersion {
+			// A record whose size was corrupted looks torn as well
+			if corrupt := checkTornTail(df, p.Checksum, err); corrupt != nil {
+				err = corrupt
+			}
+		}
+		if errors.Is(err, errPartialRecord) {
+			m.report.DiscardedBytes += size - intact
+			m.b.lo.Warn("Dropping torn tail of datafile", "id", df.ID(), "valid", intact, "discarded", size-intact)
+			err = nil
+		}
+		if err != nil {
+			return fmt.Errorf("error migrating datafile %d: %w", df.ID(), err)
+		}
+	}
+	return m.finish()
+}
+
+// copy appends the record to the datafile being written, starting a new one when it's full.
+// Records of older versions carry no sequence number and are numbered in the order they're read.
+func (m *migration) copy(record Record) error {
+	size := headerSize + int(record.Header.Ksz) + record.Header.valueSize()
+	if int64(preambleSize+size) > m.b.opts.maxActiveFileSize {
+		return fmt.Errorf("%w: key %q", ErrLargeRecord, record.Key)
+	}
+	if m.df == nil || (m.df.Offset() > preambleSize && m.df.Offset()+int64(size) > m.b.opts.maxActiveFileSize) {
+		if err := m.next(); err != nil {
+			return err
+		}
+	}
+	if record.Header.Seq == 0 {
+		record.Header.Seq = m.b.nextSeq()
+	} else {
+		m.b.seq = max(m.b.seq, record.Header.Seq)
+	}
+	if _, err := m.b.appendRecord(m.df, record.Header, record.Key, record.Value); err != nil {
+		return err
+	}
+	m.report.Records++
+	if record.Header.isTombstone() {
+		m.report.Tombstones++
+	}
+	return nil
+}
+
+// next seals the datafile being written and opens the next one.
+func (m *migration) next() error {
+	id := 0
+	if m.df != nil {
+		if err := m.seal(m.df); err != nil {
+			return err
+		}
+		id = m.df.ID() + 1
+	}
+	df, err := openDataFile(m.b.opts.dir, id, m.b.storeID, m.b.opts.checksum)
+	if err != nil {
+		return fmt.Errorf("error creating datafile %d: %w", id, err)
+	}
+	m.df = df
+	m.written = append(m.written, df)
+	return nil
+}
+
+// seal syncs a written datafile and writes its hint file.
+func (m *migration) seal(df *datafile.DataFile) error {
+	if err := df.Sync(); err != nil {
+		return fmt.Errorf("error syncing datafile %d: %w", df.ID(), err)
+	}
+	if err := m.b.writeHintFile(df); err != nil {
+		return fmt.Errorf("error writing hint file for datafile %d: %w", df.ID(), err)
+	}
+	size, err := df.Size()
+	if err != nil {
+		return err
+	}
+	m.report.FilesWritten++
+	m.report.BytesWritten += size
+	return nil
+}
+
+// finish seals the last datafile and closes every written one. A store left without
+// any records still gets an empty datafile so that it keeps its id.
+func (m *migration) finish() error {
+	if m.df == nil {
+		if err := m.next(); err != nil {
+			return err
+		}
+	}
+	if err := m.seal(m.df); err != nil {
+		return err
+	}
+	if err := syncDir(m.b.opts.dir); err != nil {
+		return err
+	}
+	for _, df := range m.written {
+		if err := df.Close(); err != nil {
+			m.b.lo.Error("Error closing migrated data file", "id", df.ID(), "error", err)
+		}
+	}
+	m.written = nil
+	return nil
+}
+
+// cleanup removes the datafiles and hint files written by a failed migration.
+func (m *migration) cleanup() {
+	for _, df := range m.written {
+		if err := m.b.removeDataFile(df); err != nil {
+			m.b.lo.Error("Error removing migrated data file", "id", df.ID(), "error", err)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package bitcasgo
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// copyFixture copies the datafiles of a store under testdata into a temporary directory,
+// since Migrate locks its source directory.
+func copyFixture(t *testing.T, name string) string {
+	t.Helper()
+	src := filepath.Join("testdata", "migrate", name)
+	files, err := filepath.Glob(filepath.Join(src, "*.db"))
+	if err != nil || len(files) == 0 {
+		t.Fatalf("no datafiles in %s: %v", src, err)
+	}
+	dir := t.TempDir()
+	for _, path := range files {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, filepath.Base(path)), data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// The fixtures were written by the releases of each format version. The first release
+// put k1, k2, k3, put k1 again, deleted k2 and put an empty value. Later releases did
+// the same, then rotated the datafile and committed a batch putting b1 and b2 and deleting k3.
+func TestMigrateLegacyVersions(t *testing.T) {
+	for _, tc := range []struct {
+		fixture string
+		version int
+		cfg     []Config
+		values  map[string]string // Expected values, deleted keys are left out
+		gone    []string
+		empty   int // Expected EmptyLegacyValues
+	}{
+		{
+			fixture: "v0-baseline",
+			version: 0,
+			values:  map[string]string{"k1": "v1b", "k2": "", "k3": "v3", "empty": ""},
+			empty:   2,
+		},
+		{
+			fixture: "v0-baseline",
+			version: 0,
+			cfg:     []Config{WithLegacyDeletes()},
+			values:  map[string]string{"k1": "v1b", "k3": "v3"},
+			gone:    []string{"k2", "empty"},
+			empty:   2,
+		},
+		{
+			fixture: "v0",
+			version: 0,
+			values:  map[string]string{"k1": "v1b", "empty": "", "b1": "x1", "b2": "x2"},
+			gone:    []string{"k2", "k3"},
+			empty:   1,
+		},
+		{
+			fixture: "v1",
+			version: 1,
+			values:  map[string]string{"k1": "v1b", "empty": "", "b1": "x1", "b2": "x2"},
+			gone:    []string{"k2", "k3"},
+		},
+		{
+			fixture: "v2",
+			version: 2,
+			values:  map[string]string{"k1": "v1b", "empty": "", "b1": "x1", "b2": "x2"},
+			gone:    []string{"k2", "k3"},
+		},
+	} {
+		t.Run(tc.fixture, func(t *testing.T) {
+			src, dst := copyFixture(t, tc.fixture), t.TempDir()
+			report, err := Migrate(src, dst, tc.cfg...)
+			if err != nil {
+				t.Fatalf("Migrate: %v", err)
+			}
+			if report.SourceVersions[tc.version] != report.FilesRead || report.FilesRead == 0 {
+				t.Errorf("source versions = %v, want %d datafiles of version %d", report.SourceVersions, report.FilesRead, tc.version)
+			}
+			if report.EmptyLegacyValues != tc.empty {
+				t.Errorf("EmptyLegacyValues = %d, want %d", report.EmptyLegacyValues, tc.empty)
+			}
+			if report.DiscardedBytes != 0 {
+				t.Errorf("DiscardedBytes = %d, want 0", report.DiscardedBytes)
+			}
+
+			b := reopenTest(t, dst)
+			for key, value := range tc.values {
+				assertGet(t, b, key, value)
+			}
+			for _, key := range tc.gone {
+				assertErr(t, b, key, ErrNoKey)
+			}
+			if n := b.KeyDir.Len(); n != len(tc.values) {
+				t.Errorf("migrated store has %d keys, want %d", n, len(tc.values))
+			}
+		})
+	}
+}
+
+func TestMigrateCurrentVersion(t *testing.T) {
+	b, src := openTest(t, WithChecksum(ChecksumCRC64))
+	mustPut(t, b, "a", "1", "b", "2", "a", "3")
+	if err := b.Delete("b"); err != nil {
+		t.Fatal(err)
+	}
+	b.Close()
+
+	dst := t.TempDir()
+	report, err := Migrate(src, dst)
+	if err != nil {
+		t.Fatalf("Migrate: %v", err)
+	}
+	if report.SourceVersions[formatVersion] != 1 {
+		t.Errorf("source versions = %v, want a datafile of version %d", report.SourceVersions, formatVersion)
+	}
+	b = reopenTest(t, dst)
+	if b.opts.checksum != ChecksumCRC64 {
+		t.Errorf("migrated store uses %s, want the crc64 of its source", b.opts.checksum)
+	}
+	assertGet(t, b, "a", "3")
+	assertErr(t, b, "b", ErrNoKey)
+}
+
+func TestMigrateCorruptRecord(t *testing.T) {
+	dir, path := crashedStore(t, func(b *BitCaspy) {
+		mustPut(t, b, "k1", "v1", "k2", "v2")
+	})
+
+	// A key size running past the end looks like a torn tail, but k2 follows it
+	editFile(t, path, func(data []byte) []byte {
+		binary.LittleEndian.PutUint32(data[preambleSize+32:], 1<<20)
+		return data
+	})
+	if _, err := Migrate(dir, t.TempDir()); !errors.Is(err, ErrCorruptDataFile) {
+		t.Fatalf("Migrate error = %v, want ErrCorruptDataFile", err)
+	}
+
+	// A flipped bit in a value aborts the migration
+	editFile(t, path, func(data []byte) []byte {
+		binary.LittleEndian.PutUint32(data[preambleSize+32:], 2)
+		data[preambleSize+headerSize+2] ^= 1
+		return data
+	})
+	if _, err := Migrate(dir, t.TempDir()); !errors.Is(err, errCorruptRecord) {
+		t.Fatalf("Migrate error = %v, want a corrupt record", err)
+	}
+}
@@ -2,35 +2,36 @@ package bitcasgo
 
 import (
 	"bytes"
+	"encoding/binary"
 	"fmt"
-	"hash/crc32"
 	"time"
 
 	datafile "bitcasgo/internal"
 )
 
 func (b *BitCaspy) get(key string) (Record, error) {
-	meta, ok := b.KeyDir[key]
+	meta, ok := b.KeyDir.Get(key)
 	if !ok {
 		return Record{}, ErrNoKey
 	}
 
-	var (
-		header Header
-		reader *datafile.DataFile
-	)
-	reader = b.df
-	// Isnot in Active data file then go to stale data files
-	if meta.fileId != b.df.ID() {
+	reader := b.df
+	// Isnot in Active data file then go to stale data files, a read-only store has no active data file
+	if b.df == nil || meta.fileId != b.df.ID() {
 		reader, ok = b.stale[meta.fileId]
 		if !ok {
-			return Record{}, fmt.Errorf("error for looking for the key  in the file %s", meta.fileId)
+			return Record{}, fmt.Errorf("error for looking for the key  in the file %d", meta.fileId)
 		}
 	}
+	return readRecord(reader, key, meta)
+}
+
+// readRecord reads the record of the key the meta points to from the datafile.
+func readRecord(reader *datafile.DataFile, key string, meta Meta) (Record, error) {
+	var header Header
 
 	// Read header first
 	data, err := reader.Read(meta.RecordPos, meta.RecordSize)
-	// headerData, err := reader.Read(meta.value_pos, int(binary.Size(header)))
 	if err != nil {
 		return Record{}, fmt.Errorf("Error reading header from database file: %v", err)
 	}
@@ -39,15 +40,10 @@ func (b *BitCaspy) get(key string) (Record, error) {
 	if err := header.Decode(data); err != nil {
 		return Record{}, fmt.Errorf("Error decoding header: %v", err)
 	}
-	fmt.Printf("Decoded header: %+v\n", header)
 	var (
-		valPos    = meta.RecordSize - int(header.Vsz)
+		valPos    = meta.RecordSize - header.valueSize()
 		valueData = data[valPos:]
 	)
-	fmt.Println("Value Data: ", valueData)
-	if err != nil {
-		return Record{}, fmt.Errorf("Error reading value from database file: %v", err)
-	}
 
 	record := Record{
 		Header: header,
@@ -57,70 +53,173 @@ func (b *BitCaspy) get(key string) (Record, error) {
 	return record, nil
 }
 
-func (b *BitCaspy) put(df *datafile.DataFile, Key string, Value []byte, expiryTime *time.Time) error {
+// getValid fetches the record of the key and rejects expired or corrupt records
+// so that every public method reports them the same way.
+func (b *BitCaspy) getValid(key string) (Record, error) {
+	record, err := b.get(key)
+	if err != nil {
+		return Record{}, err
+	}
+	if err := record.validate(b.opts.checksum); err != nil {
+		return Record{}, err
+	}
+	if record.Value, err = b.opts.decompressValue(record); err != nil {
+		return Record{}, err
+	}
+	return record, nil
+}
 
-	// Prepare the header
-	header := Header{
-		Crc:    crc32.ChecksumIEEE(Value),
-		Tstamp: uint32(time.Now().Unix()),
-		Ksz:    uint32(len(Key)),
-		Vsz:    uint32(len(Value)),
+// validateEntry checks that the key and value can be stored in a record.
+func validateEntry(key string, value []byte) error {
+	if key == "" {
+		return ErrEmptyKey
 	}
-	fmt.Println("Header: ", header.Crc, header.Tstamp, header.Ksz, header.Vsz)
-	if expiryTime != nil {
-		header.Expiry = uint32(expiryTime.Unix())
-	} else {
-		header.Expiry = 0
+	if uint64(len(key)) > uint64(^uint32(0)) {
+		return ErrLargeKey
+	}
+	if uint64(len(value)) > uint64(^uint32(0)) {
+		return ErrLargeValue
 	}
+	return nil
+}
 
-	record := Record{
-		Key:   Key,
-		Value: Value,
+// put appends the record of the key to the active datafile and points the keydir at it.
+func (b *BitCaspy) put(Key string, Value []byte, expiryTime *time.Time) error {
+	value, flags, err := b.opts.compressValue(Value)
+	if err != nil {
+		return err
+	}
+	if err := b.makeRoom(headerSize + len(Key) + len(value)); err != nil {
+		return err
+	}
+	meta, err := b.writeRecord(b.df, b.newHeader(Key, value, flags, expiryTime), Key, value)
+	if err != nil {
+		return err
+	}
+
+	b.setKey(Key, meta)
+	return nil
+}
+
+// writeRecord appends the header, key and value to the datafile and returns the
+// meta pointing at the written record. The datafile is synced if the durability asks for it.
+func (b *BitCaspy) writeRecord(df *datafile.DataFile, header Header, Key string, Value []byte) (Meta, error) {
+	meta, err := b.appendRecord(df, header, Key, Value)
+	if err != nil {
+		return Meta{}, err
 	}
 
+	// Ensure that the inmemory data of the buffer is always pushed onto the disk
+	if b.opts.durability.syncsWrites() {
+		if err := df.Sync(); err != nil {
+			return Meta{}, fmt.Errorf("Error syncing the buffer to the disk: %v", err)
+		}
+	}
+	return meta, nil
+}
+
+// appendRecord is writeRecord without the sync, for merges and migrations which
+// sync the datafiles they write once they're done with them.
+func (b *BitCaspy) appendRecord(df *datafile.DataFile, header Header, Key string, Value []byte) (Meta, error) {
 	// Get the buffer from the pool for writing data.
 	buf := b.bufPool.Get().(*bytes.Buffer)
 	defer b.bufPool.Put(buf)
 
 	defer buf.Reset()
 
-	// Encode the header
-	header.Encode(buf)
-
-	// Set the keys and values
-	buf.WriteString(Key)
-	buf.Write(Value)
+	encodeRecord(buf, b.opts.checksum, header, Key, Value)
 
 	offset, err := df.Write(buf.Bytes())
-	fmt.Println("Offset: ", offset)
 	if err != nil {
-		return fmt.Errorf("Error writing the Record to the data file: %v", err)
+		return Meta{}, fmt.Errorf("Error writing the Record to the data file: %v", err)
 	}
 
 	// Creating the meta object of the keydir
 	meta := Meta{
 		fileId:     df.ID(),
 		RecordSize: len(buf.Bytes()),
-		RecordPos:  offset + len(buf.Bytes()),
-		tstamp:     int(record.Header.Tstamp),
+		RecordPos:  offset + int64(len(buf.Bytes())),
+		tstamp:     header.Tstamp,
+		seq:        header.Seq,
 	}
-	fmt.Println("Meta: ", meta)
+	b.lo.Debug("Wrote record", "key", Key, "file_id", meta.fileId, "offset", offset, "size", meta.RecordSize)
+	return meta, nil
+}
 
-	b.KeyDir[Key] = meta
+// delete appends a tombstone for the key to the active datafile and removes it from the keydir.
+// Keys which are not in the keydir have no live record left, so nothing is written for them.
+func (b *BitCaspy) delete(Key string) error {
+	if _, ok := b.KeyDir.Get(Key); !ok {
+		return nil
+	}
 
-	// Ensure that the inmemory data of the buffer is always pushed onto the disk
-	if b.opts.alwaysFSync {
-		if err := df.Sync(); err != nil {
-			return fmt.Errorf("Error syncing the buffer to the disk: %v", err)
-		}
+	if err := b.makeRoom(headerSize + len(Key)); err != nil {
+		return err
 	}
+	meta, err := b.writeRecord(b.df, b.newTombstoneHeader(Key), Key, nil)
+	if err != nil {
+		return fmt.Errorf("Error deleting the key: %v", err)
+	}
+	b.removeKey(Key, meta)
 	return nil
 }
 
-func (b *BitCaspy) delete(Key string) error {
-	if err := b.put(b.df, Key, nil, nil); err != nil {
-		return fmt.Errorf("Error deleting the key: %v", err)
+// makeRoom rotates the active datafile if appending size bytes would grow it past
+// the max file size, so that datafiles never exceed it. Records which don't fit in
+// an empty datafile are rejected. The caller must hold the lock.
+func (b *BitCaspy) makeRoom(size int) error {
+	if int64(preambleSize+size) > b.opts.maxActiveFileSize {
+		return ErrLargeRecord
 	}
-	delete(b.KeyDir, Key)
-	return nil
+	used := b.df.Offset()
+	if used <= preambleSize || used+int64(size) <= b.opts.maxActiveFileSize {
+		return nil
+	}
+	return b.rotate(b.df.ID() + 1)
+}
+
+// newHeader prepares the header of a record holding the key and the value as it's
+// stored, described by the flags. Its checksum is set once it's encoded.
+// It draws the next sequence number, so the caller must hold the lock.
+func (b *BitCaspy) newHeader(Key string, Value []byte, flags byte, expiryTime *time.Time) Header {
+	header := Header{
+		Tstamp: time.Now().UnixNano(),
+		Seq:    b.nextSeq(),
+		Ksz:    uint32(len(Key)),
+		Vsz:    uint32(len(Value)),
+		Flags:  flags,
+	}
+	if expiryTime != nil {
+		header.Expiry = expiryTime.UnixNano()
+	}
+	return header
+}
+
+// newTombstoneHeader prepares the header of a record marking the deletion of the key.
+// It draws the next sequence number, so the caller must hold the lock.
+func (b *BitCaspy) newTombstoneHeader(Key string) Header {
+	return Header{
+		Tstamp: time.Now().UnixNano(),
+		Seq:    b.nextSeq(),
+		Ksz:    uint32(len(Key)),
+		Flags:  flagTombstone,
+	}
+}
+
+// nextSeq returns the sequence number of the next record. The caller must hold the lock.
+func (b *BitCaspy) nextSeq() uint64 {
+	b.seq++
+	return b.seq
+}
+
+// encodeRecord encodes the header followed by the key and value into the buffer
+// and sets the checksum of the record computed with the algorithm.
+func encodeRecord(buf *bytes.Buffer, c Checksum, header Header, Key string, Value []byte) {
+	start := buf.Len()
+	header.Encode(buf)
+	buf.WriteString(Key)
+	buf.Write(Value)
+
+	record := buf.Bytes()[start:]
+	binary.LittleEndian.PutUint64(record, c.sum(record[checksumSize:]))
 }
@@ -0,0 +1,426 @@
+package bitcasgo
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+
+	datafile "bitcasgo/internal"
+)
+
+// errPartialRecord is returned while scanning a datafile whose tail holds a
+// record that was only partially written, usually because of a crash mid-append.
+var errPartialRecord = errors.New("partial record at the end of datafile")
+
+// errCorruptBatch is returned when the control records of a batch don't add up.
+var errCorruptBatch = errors.New("corrupt batch in datafile")
+
+// errCorruptRecord is returned while scanning with checksums for a record whose value
+// doesn't match its checksum.
+var errCorruptRecord = errors.New("corrupt record in datafile")
+
+// ErrCorruptDataFile is returned by Init when a record in the middle of the last datafile
+// is corrupt. Unlike a torn write at its end, it can't be truncated away without losing
+// the intact records written after it. Opened read-only, the datafile is left as it is.
+var ErrCorruptDataFile = errors.New("corrupt record followed by intact records in datafile")
+
+// recordError locates the record at which a scan of a datafile stopped.
+type recordError struct {
+	offset int64 // Offset of the start of the record
+	next   int64 // Offset right after the record as its header has it, zero if it doesn't fit
+	err    error
+}
+
+func (e *recordError) Error() string {
+	return fmt.Sprintf("%v at offset %d", e.err, e.offset)
+}
+
+func (e *recordError) Unwrap() error {
+	return e.err
+}
+
+// scanDataFile walks every record of the datafile from the start and calls fn
+// with the decoded record and the meta pointing at its location in the file.
+// Records written by a batch are only passed on once its commit marker is seen,
+// so a batch torn by a crash is dropped as a whole and reported as errPartialRecord.
+func scanDataFile(df *datafile.DataFile, c Checksum, fn func(record Record, meta Meta) error) error {
+	_, err := scanRecords(df, c, false, fn)
+	return err
+}
+
+// scanRecords is scanDataFile, optionally verifying the checksum of every record.
+// Control records are always verified.
+// It returns the size of the intact start of the datafile, up to the end of the
+// last record which isn't part of an uncommitted batch.
+func scanRecords(df *datafile.DataFile, c Checksum, verify bool, fn func(record Record, meta Meta) error) (int64, error) {
+	size, err := df.Size()
+	if err != nil {
+		return 0, err
+	}
+
+	type scanned struct {
+		record Record
+		meta   Meta
+	}
+	var (
+		pending []scanned // Records of the batch being replayed
+		inBatch bool
+	)
+
+	// Records follow the preamble
+	offset, intact := int64(preambleSize), int64(preambleSize)
+	if size < preambleSize {
+		return size, nil
+	}
+	for offset < size {
+		if offset+headerSize > size {
+			return intact, errPartialRecord
+		}
+
+		data, err := df.Read(offset+headerSize, headerSize)
+		if err != nil {
+			return intact, fmt.Errorf("error reading header at offset %d: %w", offset, err)
+		}
+
+		var header Header
+		if err := header.Decode(data); err != nil {
+			return intact, fmt.Errorf("error decoding header at offset %d: %w", offset, err)
+		}
+
+		recordSize := headerSize + int(header.Ksz) + header.valueSize()
+		if offset+int64(recordSize) > size {
+			return intact, &recordError{offset: offset, err: errPartialRecord}
+		}
+
+		data, err = df.Read(offset+int64(recordSize), recordSize)
+		if err != nil {
+			return intact, fmt.Errorf("error reading record at offset %d: %w", offset, err)
+		}
+
+		record := Record{
+			Header: header,
+			Key:    string(data[headerSize : headerSize+int(header.Ksz)]),
+			Value:  data[headerSize+int(header.Ksz):],
+		}
+		meta := Meta{
+			fileId:     df.ID(),
+			RecordSize: recordSize,
+			RecordPos:  offset + int64(recordSize),
+			tstamp:     header.Tstamp,
+			seq:        header.Seq,
+		}
+		if verify && !record.isValidChecksum(c) {
+			return intact, &recordError{offset: offset, next: offset + int64(recordSize), err: fmt.Errorf("%w: checksum mismatch", errCorruptRecord)}
+		}
+		start := offset
+		offset += int64(recordSize)
+
+		if header.isControl() {
+			kind, count, ok := record.control(c)
+			if !ok {
+				return intact, &recordError{offset: start, next: offset, err: fmt.Errorf("%w: invalid control record", errCorruptBatch)}
+			}
+			switch kind {
+			case flagBatchBegin:
+				pending, inBatch = pending[:0], true
+			case flagBatchCommit:
+				if !inBatch || count != len(pending) {
+					return intact, &recordError{offset: start, next: offset, err: fmt.Errorf("%w: unexpected commit", errCorruptBatch)}
+				}
+				for _, p := range pending {
+					if err := fn(p.record, p.meta); err != nil {
+						return intact, err
+					}
+				}
+				pending, inBatch = pending[:0], false
+				intact = offset
+			}
+			continue
+		}
+
+		if inBatch {
+			pending = append(pending, scanned{record: record, meta: meta})
+			continue
+		}
+		if err := fn(record, meta); err != nil {
+			return intact, err
+		}
+		intact = offset
+	}
+
+	// A batch without its commit marker never made it to disk completely
+	if inBatch {
+		return intact, errPartialRecord
+	}
+	return intact, nil
+}
+
+const (
+	// tornTailWindow bounds how far past a corrupt record intactRecordAfter looks for
+	// an intact one, so a corrupt record early in a large datafile doesn't mean reading
+	// all of it. Records written after a corrupt one follow it closely, unless the corrupt
+	// one is large, in which case its header usually still tells where it ends.
+	tornTailWindow = 1 << 20
+	// tornTailChunk is the size of the chunks the datafile is read in while looking.
+	tornTailChunk = 64 << 10
+)
+
+// checkTornTail tells a torn write at the end of a datafile, as reported by scanRecords,
+// from a record corrupted in the middle of it. The latter is followed by intact records
+// and reported as ErrCorruptDataFile, whereas nil is returned for a torn write.
+func checkTornTail(df *datafile.DataFile, c Checksum, scanErr error) error {
+	var re *recordError
+	if !errors.As(scanErr, &re) {
+		return nil
+	}
+	size, err := df.Size()
+	if err != nil {
+		return fmt.Errorf("error checking datafile %d: %w", df.ID(), err)
+	}
+
+	// The record right behind a corrupt record which fits, then anything close to it
+	next, ok := re.next, false
+	if re.next > 0 {
+		ok, err = intactRecordAt(df, c, re.next, size)
+	}
+	if err == nil && !ok {
+		next, ok, err = intactRecordAfter(df, c, re.offset+1, min(size, re.offset+1+tornTailWindow))
+	}
+	if err != nil {
+		return fmt.Errorf("error checking datafile %d: %w", df.ID(), err)
+	}
+	if ok {
+		return fmt.Errorf("%w: datafile %d has %v, intact records follow at offset %d", ErrCorruptDataFile, df.ID(), re, next)
+	}
+	return nil
+}
+
+// intactRecordAfter looks for a record with a valid checksum starting anywhere from
+// the offset and ending by the limit, and returns where it starts. A torn write leaves
+// nothing intact behind it. The datafile is read in chunks of tornTailChunk.
+func intactRecordAfter(df *datafile.DataFile, c Checksum, from, limit int64) (int64, bool, error) {
+	for chunk := from; chunk+headerSize <= limit; chunk += tornTailChunk {
+		// Headers starting within the chunk
+		n := min(int64(tornTailChunk+headerSize-1), limit-chunk)
+		data, err := df.Read(chunk+n, int(n))
+		if err != nil {
+			return 0, false, err
+		}
+		for i := 0; i < tornTailChunk && i+headerSize <= len(data); i++ {
+			var header Header
+			if err := header.Decode(data[i:]); err != nil {
+				return 0, false, err
+			}
+			start := chunk + int64(i)
+			ok, err := isIntactRecord(df, c, start, header, limit)
+			if err != nil {
+				return 0, false, err
+			}
+			if ok {
+				return start, true, nil
+			}
+		}
+	}
+	return 0, false, nil
+}
+
+// intactRecordAt reports whether an intact record starts at the offset and ends by the limit.
+func intactRecordAt(df *datafile.DataFile, c Checksum, offset, limit int64) (bool, error) {
+	if offset+headerSize > limit {
+		return false, nil
+	}
+	data, err := df.Read(offset+headerSize, headerSize)
+	if err != nil {
+		return false, err
+	}
+	var header Header
+	if err := header.Decode(data); err != nil {
+		return false, err
+	}
+	return isIntactRecord(df, c, offset, header, limit)
+}
+
+// isIntactRecord reports whether the record with the header starting at the offset
+// ends by the limit and matches its checksum, which is computed over chunks of the datafile.
+func isIntactRecord(df *datafile.DataFile, c Checksum, offset int64, header Header, limit int64) (bool, error) {
+	// Only control records have an empty key
+	if header.Ksz == 0 && !header.isControl() {
+		return false, nil
+	}
+	end := offset + headerSize + int64(header.Ksz) + int64(header.valueSize())
+	if end > limit {
+		return false, nil
+	}
+	var crc uint64
+	for pos := offset + checksumSize; pos < end; {
+		n := min(int64(tornTailChunk), end-pos)
+		data, err := df.Read(pos+n, int(n))
+		if err != nil {
+			return false, err
+		}
+		crc = c.update(crc, data)
+		pos += n
+	}
+	return crc == header.Crc, nil
+}
+
+// RecoveryReport describes the check of the last datafile made while opening the
+// database. Its tail holds a torn write if the process died in the middle of an append.
+type RecoveryReport struct {
+	Checked        bool   // Whether the datafile was checked, it's skipped after a clean shutdown
+	FileID         int    // Id of the last datafile
+	ValidBytes     int64  // Size of the intact records at the start of the datafile
+	DiscardedBytes int64  // Size of the torn tail after the intact records
+	Truncated      bool   // Whether the torn tail was removed, it's kept in read-only mode
+	Reason         string // What was wrong with the torn tail
+}
+
+// Recovery returns the report of the check of the last datafile made while opening the database.
+func (b *BitCaspy) Recovery() RecoveryReport {
+	return b.recovery
+}
+
+// recoverTail checks the records of the datafile which was active when the database
+// was last open and truncates any partial or corrupt records from its end. A corrupt
+// record followed by intact ones isn't a torn write and fails with ErrCorruptDataFile
+// rather than losing the records after it, unless the database is opened read-only.
+// The check is skipped if the datafile has a hint file, which is only written
+// once the datafile can't be appended to anymore.
+func (b *BitCaspy) recoverTail(df *datafile.DataFile) error {
+	report := RecoveryReport{FileID: df.ID()}
+	defer func() { b.recovery = report }()
+	if exists(b.hintPath(df.ID())) {
+		return nil
+	}
+
+	size, err := df.Size()
+	if err != nil {
+		return err
+	}
+	report.Checked = true
+
+	intact, err := scanRecords(df, b.opts.checksum, true, func(Record, Meta) error { return nil })
+	report.ValidBytes = intact
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, errPartialRecord) && !errors.Is(err, errCorruptRecord) && !errors.Is(err, errCorruptBatch) {
+		return fmt.Errorf("error checking datafile %d: %w", df.ID(), err)
+	}
+
+	report.Reason = err.Error()
+	if err := checkTornTail(df, b.opts.checksum, err); err != nil {
+		if !b.opts.readOnly {
+			return err
+		}
+		b.lo.Warn("Found corrupt record in datafile, keeping it in read-only mode", "id", df.ID(), "error", err)
+		return nil
+	}
+
+	report.DiscardedBytes = size - intact
+	if b.opts.readOnly {
+		b.lo.Warn("Found torn tail in datafile, keeping it in read-only mode", "id", df.ID(), "valid", intact, "discarded", report.DiscardedBytes, "reason", report.Reason)
+		return nil
+	}
+	if err := df.Truncate(intact); err != nil {
+		return fmt.Errorf("error truncating datafile %d: %w", df.ID(), err)
+	}
+	report.Truncated = true
+	b.lo.Warn("Truncated torn tail of datafile", "id", df.ID(), "valid", intact, "discarded", report.DiscardedBytes, "reason", report.Reason)
+	return nil
+}
+
+// loadKeyDir builds the keydir from scratch by replaying every datafile in the
+// order of their ids. The record of a key with the highest sequence number wins,
+// whichever datafile it's in, and deleted keys are dropped.
+// Immutable datafiles are replayed from their hint files where present and valid,
+// otherwise the datafile itself is scanned and a fresh hint file is written for it.
+func (b *BitCaspy) loadKeyDir() error {
+	ids := make([]int, 0, len(b.stale))
+	for id := range b.stale {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	b.KeyDir = b.opts.newKeyDir()
+	b.stats = make(map[int]*FileStats)
+	// Sequence numbers of the tombstones of deleted keys, so that an older record
+	// of the key replayed afterwards doesn't bring it back
+	deleted := make(map[string]uint64)
+	apply := func(key string, meta Meta, tombstone bool) {
+		b.seq = max(b.seq, meta.seq)
+		latest := deleted[key]
+		if cur, ok := b.KeyDir.Get(key); ok {
+			latest = cur.seq
+		}
+		if meta.seq < latest {
+			if tombstone {
+				b.addTombstone(meta)
+				return
+			}
+			b.addDead(meta)
+			return
+		}
+		if tombstone {
+			b.removeKey(key, meta)
+			deleted[key] = meta.seq
+			return
+		}
+		b.setKey(key, meta)
+		delete(deleted, key)
+	}
+
+	for _, id := range ids {
+		df := b.stale[id]
+		entries, summary, err := b.readHintFile(df)
+		if err == nil {
+			for _, entry := range entries {
+				apply(entry.Key, entry.meta(id), entry.isTombstone())
+			}
+			// Records overwritten within the datafile are left out of its hint file
+			s := b.fileStats(id)
+			s.DeadKeys += int(summary.DeadRecords)
+			s.DeadBytes += int64(summary.DeadBytes)
+			continue
+		}
+		if !os.IsNotExist(err) {
+			b.lo.Warn("Ignoring unusable hint file", "id", id, "error", err)
+		}
+
+		if err := b.scanIntoKeyDir(df, apply); err != nil {
+			return err
+		}
+		if !b.opts.readOnly {
+			if err := b.writeHintFile(df); err != nil {
+				b.lo.Error("Error writing hint file", "id", id, "error", err)
+			}
+		}
+	}
+
+	// The active datafile never has a hint file, a read-only store has none at all.
+	if b.df == nil {
+		return nil
+	}
+	if err := b.scanIntoKeyDir(b.df, apply); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// scanIntoKeyDir replays every record of the datafile through apply.
+func (b *BitCaspy) scanIntoKeyDir(df *datafile.DataFile, apply func(key string, meta Meta, tombstone bool)) error {
+	err := scanDataFile(df, b.opts.checksum, func(record Record, meta Meta) error {
+		apply(record.Key, meta, record.Header.isTombstone())
+		return nil
+	})
+	if errors.Is(err, errPartialRecord) {
+		b.lo.Warn("Ignoring partial record at the end of datafile", "id", df.ID())
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error scanning datafile %d: %w", df.ID(), err)
+	}
+	return nil
+}
@@ -0,0 +1,214 @@
+package bitcasgo
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+// crashedStore writes the records with a database in a fresh directory and leaves its
+// last datafile as if the process died, with no hint file. It returns the directory
+// and the path of the last datafile.
+func crashedStore(t *testing.T, write func(b *BitCaspy)) (string, string) {
+	t.Helper()
+	b, dir := openTest(t)
+	write(b)
+	id := b.df.ID()
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(b.hintPath(id)); err != nil {
+		t.Fatal(err)
+	}
+	return dir, b.dataPath(id)
+}
+
+// editFile applies fn to the contents of the file.
+func editFile(t *testing.T, path string, fn func(data []byte) []byte) {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, fn(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func fileSize(t *testing.T, path string) int64 {
+	t.Helper()
+	st, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return st.Size()
+}
+
+// recordSize is the size of a record of the key and value on disk.
+func recordSize(key, value string) int64 {
+	return int64(headerSize + len(key) + len(value))
+}
+
+func TestRecoverTornTail(t *testing.T) {
+	dir, path := crashedStore(t, func(b *BitCaspy) {
+		mustPut(t, b, "k1", "v1", "k2", "v2", "k3", "v3")
+	})
+	editFile(t, path, func(data []byte) []byte { return data[:len(data)-5] })
+
+	b := reopenTest(t, dir)
+	assertGet(t, b, "k1", "v1")
+	assertGet(t, b, "k2", "v2")
+	assertErr(t, b, "k3", ErrNoKey)
+
+	valid := preambleSize + 2*recordSize("k1", "v1")
+	report := b.Recovery()
+	if !report.Checked || !report.Truncated || report.ValidBytes != valid || report.DiscardedBytes != recordSize("k3", "v3")-5 {
+		t.Fatalf("unexpected recovery report %+v", report)
+	}
+	if size := fileSize(t, path); size != valid {
+		t.Fatalf("datafile is %d bytes after recovery, want %d", size, valid)
+	}
+}
+
+func TestRecoverCorruptLastRecord(t *testing.T) {
+	dir, path := crashedStore(t, func(b *BitCaspy) {
+		mustPut(t, b, "k1", "v1", "k2", "v2")
+	})
+	editFile(t, path, func(data []byte) []byte {
+		data[len(data)-1] ^= 0xff
+		return data
+	})
+
+	b := reopenTest(t, dir)
+	assertGet(t, b, "k1", "v1")
+	assertErr(t, b, "k2", ErrNoKey)
+	if report := b.Recovery(); !report.Truncated || report.DiscardedBytes != recordSize("k2", "v2") {
+		t.Fatalf("unexpected recovery report %+v", report)
+	}
+}
+
+func TestRecoverCorruptRecordInTheMiddle(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		corrupt  func(data []byte)
+		readable bool // Whether the records after it can be read in read-only mode
+	}{
+		// A flipped bit in the value of the first record
+		{"value", func(data []byte) { data[preambleSize+headerSize+2] ^= 1 }, true},
+		// A key size running past the end of the datafile, which looks like a torn write
+		{"size", func(data []byte) { binary.LittleEndian.PutUint32(data[preambleSize+32:], 1<<20) }, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir, path := crashedStore(t, func(b *BitCaspy) {
+				mustPut(t, b, "k1", "v1", "k2", "v2", "k3", "v3")
+			})
+			editFile(t, path, func(data []byte) []byte {
+				tc.corrupt(data)
+				return data
+			})
+			size := fileSize(t, path)
+
+			_, err := Init(WithDir(dir))
+			if !errors.Is(err, ErrCorruptDataFile) {
+				t.Fatalf("Init error = %v, want ErrCorruptDataFile", err)
+			}
+			if got := fileSize(t, path); got != size {
+				t.Fatalf("datafile was cut from %d to %d bytes", size, got)
+			}
+
+			b := reopenTest(t, dir, WithReadOnly())
+			if got := fileSize(t, path); got != size {
+				t.Fatalf("datafile was cut from %d to %d bytes in read-only mode", size, got)
+			}
+			if tc.readable {
+				assertErr(t, b, "k1", ErrChecksumMismatch)
+				assertGet(t, b, "k2", "v2")
+				assertGet(t, b, "k3", "v3")
+			}
+		})
+	}
+}
+
+func TestRecoverCorruptLargeRecord(t *testing.T) {
+	large := strings.Repeat("x", 3*tornTailWindow)
+	// Offset of a byte of the value of the large record, well into it
+	at := preambleSize + recordSize("k1", "v1") + headerSize + int64(len("big")) + tornTailWindow
+
+	t.Run("value", func(t *testing.T) {
+		dir, path := crashedStore(t, func(b *BitCaspy) {
+			mustPut(t, b, "k1", "v1", "big", large, "k2", "v2")
+		})
+		// The intact record of k2 starts further behind the flipped byte than the window searched
+		editFile(t, path, func(data []byte) []byte {
+			data[at] ^= 1
+			return data
+		})
+		if _, err := Init(WithDir(dir)); !errors.Is(err, ErrCorruptDataFile) {
+			t.Fatalf("Init error = %v, want ErrCorruptDataFile", err)
+		}
+	})
+
+	t.Run("torn", func(t *testing.T) {
+		dir, path := crashedStore(t, func(b *BitCaspy) {
+			mustPut(t, b, "k1", "v1", "big", large)
+		})
+		editFile(t, path, func(data []byte) []byte { return data[:at] })
+
+		b := reopenTest(t, dir)
+		if r := b.Recovery(); !r.Truncated {
+			t.Fatalf("torn tail wasn't truncated: %+v", r)
+		}
+		assertGet(t, b, "k1", "v1")
+		assertErr(t, b, "big", ErrNoKey)
+	})
+}
+
+func TestRecoverBatchAllOrNothing(t *testing.T) {
+	write := func(b *BitCaspy) {
+		mustPut(t, b, "k0", "v0")
+		batch := b.NewBatch()
+		for _, key := range []string{"a", "b", "c"} {
+			if err := batch.Put(key, []byte(key)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := batch.Delete("k0"); err != nil {
+			t.Fatal(err)
+		}
+		if err := batch.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("committed", func(t *testing.T) {
+		dir, _ := crashedStore(t, write)
+		b := reopenTest(t, dir)
+		assertErr(t, b, "k0", ErrNoKey)
+		for _, key := range []string{"a", "b", "c"} {
+			assertGet(t, b, key, key)
+		}
+		if report := b.Recovery(); !report.Checked || report.DiscardedBytes != 0 {
+			t.Fatalf("unexpected recovery report %+v", report)
+		}
+	})
+
+	// The commit marker is torn, so none of the batch is applied
+	t.Run("torn", func(t *testing.T) {
+		dir, path := crashedStore(t, write)
+		editFile(t, path, func(data []byte) []byte { return data[:len(data)-3] })
+		b := reopenTest(t, dir)
+		assertGet(t, b, "k0", "v0")
+		for _, key := range []string{"a", "b", "c"} {
+			assertErr(t, b, key, ErrNoKey)
+		}
+		valid := preambleSize + recordSize("k0", "v0")
+		if report := b.Recovery(); !report.Truncated || report.ValidBytes != valid {
+			t.Fatalf("unexpected recovery report %+v", report)
+		}
+		if size := fileSize(t, path); size != valid {
+			t.Fatalf("datafile is %d bytes after recovery, want %d", size, valid)
+		}
+	})
+}
@@ -0,0 +1,181 @@
+package bitcasgo
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// settings maps the names of the options which can be loaded from a file or the
+// environment to a function parsing and setting them. Values are checked by Init
+// along with every other option.
+var settings = map[string]func(o *Options, v string) error{
+	"dir": func(o *Options, v string) error {
+		o.dir = v
+		return nil
+	},
+	"debug": func(o *Options, v string) error {
+		return parseSetting(v, strconv.ParseBool, &o.debug)
+	},
+	"read_only": func(o *Options, v string) error {
+		return parseSetting(v, strconv.ParseBool, &o.readOnly)
+	},
+	"durability": func(o *Options, v string) error {
+		return parseSetting(v, parseDurability, &o.durability)
+	},
+	// Kept for older configs, the same as the group_commit durability mode
+	"always_sync": func(o *Options, v string) error {
+		var always bool
+		if err := parseSetting(v, strconv.ParseBool, &always); err != nil {
+			return err
+		}
+		if always {
+			o.durability = SyncGroupCommit
+		}
+		return nil
+	},
+	"checksum": func(o *Options, v string) error {
+		return parseSetting(v, parseChecksum, &o.checksum)
+	},
+	"compression": func(o *Options, v string) error {
+		return parseSetting(v, parseCompressor, &o.compressor)
+	},
+	"compression_min_size": func(o *Options, v string) error {
+		return parseSetting(v, strconv.Atoi, &o.compressionMinSize)
+	},
+	"legacy_deletes": func(o *Options, v string) error {
+		return parseSetting(v, strconv.ParseBool, &o.legacyDeletes)
+	},
+	// Like WithSyncInterval it switches to the interval durability mode, it's refused
+	// along with a mode which doesn't sync periodically
+	"sync_interval": func(o *Options, v string) error {
+		if err := parseSetting(v, time.ParseDuration, &o.syncInterval); err != nil {
+			return err
+		}
+		switch o.durability {
+		case SyncNone:
+			o.durability = SyncInterval
+		case SyncInterval:
+		default:
+			return fmt.Errorf("only applies to the %s durability mode, not %s", SyncInterval, o.durability)
+		}
+		return nil
+	},
+	"compact_interval": func(o *Options, v string) error {
+		return parseSetting(v, time.ParseDuration, &o.compactInterval)
+	},
+	"check_file_size_interval": func(o *Options, v string) error {
+		return parseSetting(v, time.ParseDuration, &o.checkFileSizeInterval)
+	},
+	"max_file_size": func(o *Options, v string) error {
+		return parseSetting(v, parseInt64, &o.maxActiveFileSize)
+	},
+	"frag_merge_trigger": func(o *Options, v string) error {
+		return parseSetting(v, parseFloat64, &o.fragMergeTrigger)
+	},
+	"dead_bytes_merge_trigger": func(o *Options, v string) error {
+		return parseSetting(v, parseInt64, &o.deadBytesMergeTrigger)
+	},
+	"frag_threshold": func(o *Options, v string) error {
+		return parseSetting(v, parseFloat64, &o.fragThreshold)
+	},
+	"dead_bytes_threshold": func(o *Options, v string) error {
+		return parseSetting(v, parseInt64, &o.deadBytesThreshold)
+	},
+	"merge_window_start": func(o *Options, v string) error {
+		return parseSetting(v, strconv.Atoi, &o.mergeWindowStart)
+	},
+	"merge_window_end": func(o *Options, v string) error {
+		return parseSetting(v, strconv.Atoi, &o.mergeWindowEnd)
+	},
+}
+
+func parseSetting[T any](v string, parse func(string) (T, error), dst *T) error {
+	val, err := parse(v)
+	if err != nil {
+		return err
+	}
+	*dst = val
+	return nil
+}
+
+func parseInt64(v string) (int64, error) {
+	return strconv.ParseInt(v, 10, 64)
+}
+
+func parseFloat64(v string) (float64, error) {
+	return strconv.ParseFloat(v, 64)
+}
+
+// applySetting sets the named option from its textual value.
+func (o *Options) applySetting(name, value string) error {
+	set, ok := settings[name]
+	if !ok {
+		return &OptionError{Option: name, Value: value, Reason: "unknown option"}
+	}
+	if err := set(o, value); err != nil {
+		return &OptionError{Option: name, Value: value, Reason: err.Error()}
+	}
+	return nil
+}
+
+// WithConfigFile loads options from a JSON file holding an object keyed by option
+// name, such as {"dir": "/var/lib/bitcaspy", "durability": "interval", "sync_interval": "1s"}.
+// Durations are given as strings parsed by time.ParseDuration and durability modes by
+// the names returned by Durability.String. Unknown options are rejected.
+func WithConfigFile(path string) Config {
+	return func(o *Options) error {
+		f, err := os.Open(path)
+		if err != nil {
+			return fmt.Errorf("error opening config file: %w", err)
+		}
+		defer f.Close()
+
+		var values map[string]any
+		dec := json.NewDecoder(f)
+		dec.UseNumber()
+		if err := dec.Decode(&values); err != nil {
+			return fmt.Errorf("error parsing config file %s: %w", path, err)
+		}
+
+		// Apply the options in a fixed order so errors are reported consistently
+		names := make([]string, 0, len(values))
+		for name := range values {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if err := o.applySetting(name, fmt.Sprint(values[name])); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// WithEnv loads options from the environment variables named after the options
+// in upper case with the given prefix, such as BITCASPY_DIR or BITCASPY_MAX_FILE_SIZE
+// for the prefix "BITCASPY". Options without a variable are left untouched.
+func WithEnv(prefix string) Config {
+	return func(o *Options) error {
+		names := make([]string, 0, len(settings))
+		for name := range settings {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			value, ok := os.LookupEnv(prefix + "_" + strings.ToUpper(name))
+			if !ok {
+				continue
+			}
+			if err := o.applySetting(name, value); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
@@ -0,0 +1,200 @@
+package bitcasgo
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeConfig writes the config file contents into a temporary file and returns its path.
+func writeConfig(t *testing.T, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(contents), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// applyConfig applies the config to the default options.
+func applyConfig(cfg Config) (*Options, error) {
+	o := DefaultOptions()
+	return o, cfg(o)
+}
+
+func TestWithConfigFile(t *testing.T) {
+	o, err := applyConfig(WithConfigFile(writeConfig(t, `{
+		"dir": "/var/lib/bitcaspy",
+		"read_only": true,
+		"durability": "group_commit",
+		"checksum": "crc64",
+		"compression": "gzip",
+		"compression_min_size": 64,
+		"compact_interval": "1h",
+		"max_file_size": 1048576,
+		"frag_merge_trigger": 50.5,
+		"merge_window_start": 2,
+		"merge_window_end": 5
+	}`)))
+	if err != nil {
+		t.Fatalf("WithConfigFile: %v", err)
+	}
+	switch {
+	case o.dir != "/var/lib/bitcaspy":
+		t.Errorf("dir = %q", o.dir)
+	case !o.readOnly:
+		t.Errorf("read_only = false")
+	case o.durability != SyncGroupCommit:
+		t.Errorf("durability = %s", o.durability)
+	case o.checksum != ChecksumCRC64:
+		t.Errorf("checksum = %s", o.checksum)
+	case o.compressor == nil || o.compressor.ID() != compressorGzip:
+		t.Errorf("compression = %v", o.compressor)
+	case o.compressionMinSize != 64:
+		t.Errorf("compression_min_size = %d", o.compressionMinSize)
+	case o.compactInterval != time.Hour:
+		t.Errorf("compact_interval = %s", o.compactInterval)
+	case o.maxActiveFileSize != 1<<20:
+		t.Errorf("max_file_size = %d", o.maxActiveFileSize)
+	case o.fragMergeTrigger != 50.5:
+		t.Errorf("frag_merge_trigger = %v", o.fragMergeTrigger)
+	case o.mergeWindowStart != 2 || o.mergeWindowEnd != 5:
+		t.Errorf("merge window = %d-%d", o.mergeWindowStart, o.mergeWindowEnd)
+	}
+	// Options missing from the file keep their defaults
+	if o.syncInterval != defaultSyncInterval || o.checkFileSizeInterval != defaultFileSizeInterval {
+		t.Errorf("options missing from the file changed")
+	}
+}
+
+func TestWithConfigFileErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		contents string
+		option   string // Option of the OptionError, empty for other errors
+	}{
+		{"unknown option", `{"nope": 1}`, "nope"},
+		{"invalid value", `{"max_file_size": "big"}`, "max_file_size"},
+		{"invalid duration", `{"compact_interval": 10}`, "compact_interval"},
+		{"unknown durability", `{"durability": "sometimes"}`, "durability"},
+		{"malformed", `{"dir": `, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := applyConfig(WithConfigFile(writeConfig(t, tc.contents)))
+			assertOptionError(t, err, tc.option)
+		})
+	}
+
+	if _, err := applyConfig(WithConfigFile(filepath.Join(t.TempDir(), "missing.json"))); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("missing config file: error = %v, want os.ErrNotExist", err)
+	}
+}
+
+func TestWithEnv(t *testing.T) {
+	t.Setenv("BCTEST_DIR", "/tmp/bitcaspy")
+	t.Setenv("BCTEST_DEBUG", "true")
+	t.Setenv("BCTEST_MAX_FILE_SIZE", "4096")
+	t.Setenv("BCTEST_CHECK_FILE_SIZE_INTERVAL", "30s")
+	// Variables of another prefix are ignored
+	t.Setenv("OTHER_READ_ONLY", "true")
+
+	o, err := applyConfig(WithEnv("BCTEST"))
+	if err != nil {
+		t.Fatalf("WithEnv: %v", err)
+	}
+	switch {
+	case o.dir != "/tmp/bitcaspy":
+		t.Errorf("dir = %q", o.dir)
+	case !o.debug:
+		t.Errorf("debug = false")
+	case o.maxActiveFileSize != 4096:
+		t.Errorf("max_file_size = %d", o.maxActiveFileSize)
+	case o.checkFileSizeInterval != 30*time.Second:
+		t.Errorf("check_file_size_interval = %s", o.checkFileSizeInterval)
+	case o.readOnly:
+		t.Errorf("read_only = true")
+	}
+
+	t.Setenv("BCTEST_READ_ONLY", "maybe")
+	_, err = applyConfig(WithEnv("BCTEST"))
+	assertOptionError(t, err, "read_only")
+}
+
+func TestSyncIntervalSetting(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		contents   string
+		durability Durability
+		option     string // Option of the OptionError, empty if it's accepted
+	}{
+		// Setting the interval alone syncs on it, like WithSyncInterval
+		{"alone", `{"sync_interval": "1s"}`, SyncInterval, ""},
+		{"interval", `{"durability": "interval", "sync_interval": "1s"}`, SyncInterval, ""},
+		{"always sync", `{"always_sync": true, "sync_interval": "1s"}`, SyncGroupCommit, "sync_interval"},
+		{"every write", `{"durability": "every_write", "sync_interval": "1s"}`, SyncEveryWrite, "sync_interval"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			o, err := applyConfig(WithConfigFile(writeConfig(t, tc.contents)))
+			if tc.option != "" {
+				assertOptionError(t, err, tc.option)
+				return
+			}
+			if err != nil {
+				t.Fatalf("WithConfigFile: %v", err)
+			}
+			if o.durability != tc.durability || o.syncInterval != time.Second {
+				t.Fatalf("durability %s every %s, want %s every 1s", o.durability, o.syncInterval, tc.durability)
+			}
+		})
+	}
+
+	t.Setenv("BCTEST_SYNC_INTERVAL", "2s")
+	o, err := applyConfig(WithEnv("BCTEST"))
+	if err != nil {
+		t.Fatalf("WithEnv: %v", err)
+	}
+	if o.durability != SyncInterval || o.syncInterval != 2*time.Second {
+		t.Fatalf("durability %s every %s, want interval every 2s", o.durability, o.syncInterval)
+	}
+}
+
+func TestInitWithConfigFile(t *testing.T) {
+	dir := t.TempDir()
+	path := writeConfig(t, `{"dir": "`+filepath.ToSlash(dir)+`", "durability": "every_write"}`)
+
+	b, err := Init(WithConfigFile(path))
+	if err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+	defer b.Close()
+	mustPut(t, b, "k", "v")
+	if _, err := os.Stat(filepath.Join(dir, "bitcaspy_0.db")); err != nil {
+		t.Fatalf("datafile isn't in the configured dir: %v", err)
+	}
+
+	// Options applied after the file override it
+	if _, err := Init(WithConfigFile(path), WithDir(dir), WithMaxFileSize(1)); !errors.As(err, new(*OptionError)) {
+		t.Fatalf("Init error = %v, want an OptionError", err)
+	}
+}
+
+// assertOptionError checks that err is an OptionError for the option, or any other
+// error if option is empty.
+func assertOptionError(t *testing.T, err error, option string) {
+	t.Helper()
+	if err == nil {
+		t.Fatalf("got no error, want one for option %q", option)
+	}
+	var oe *OptionError
+	if option == "" {
+		if errors.As(err, &oe) {
+			t.Fatalf("error = %v, want no OptionError", err)
+		}
+		return
+	}
+	if !errors.As(err, &oe) || oe.Option != option {
+		t.Fatalf("error = %v, want an OptionError for %q", err, option)
+	}
+}
@@ -0,0 +1,92 @@
+package bitcasgo
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	datafile "bitcasgo/internal"
+)
+
+// snapshot is a point in time view of the keydir along with the datafiles it points into.
+// Taking one is cheap since the keydir shares its unchanged parts with the snapshot.
+// Datafiles removed by a merge are kept around until every open snapshot is released.
+// Transactions and iterators read through snapshots.
+type snapshot struct {
+	keyDir   KeyDir
+	files    map[int]*datafile.DataFile
+	closed   *atomic.Bool // Set once the database is closed and the datafiles can't be read anymore
+	checksum Checksum     // Algorithm checksumming the records of the store
+}
+
+// newSnapshot captures the current keydir and datafiles. The caller must hold
+// at least the read lock and release the snapshot once done.
+func (b *BitCaspy) newSnapshot() *snapshot {
+	files := make(map[int]*datafile.DataFile, len(b.stale)+1)
+	for id, df := range b.stale {
+		files[id] = df
+	}
+	if b.df != nil {
+		files[b.df.ID()] = b.df
+	}
+
+	b.snapshots.Add(1)
+	return &snapshot{
+		keyDir:   b.KeyDir.Snapshot(),
+		files:    files,
+		closed:   &b.closed,
+		checksum: b.opts.checksum,
+	}
+}
+
+func (b *BitCaspy) releaseSnapshot(s *snapshot) {
+	if s.keyDir == nil {
+		return
+	}
+	s.keyDir, s.files = nil, nil
+	if b.snapshots.Add(-1) == 0 {
+		if err := b.removeRetired(); err != nil {
+			b.lo.Error("Error removing merged datafiles", "error", err)
+		}
+	}
+}
+
+// get reads the record of the key as of the snapshot.
+func (s *snapshot) get(key string) (Record, error) {
+	meta, ok := s.keyDir.Get(key)
+	if !ok {
+		return Record{}, ErrNoKey
+	}
+	return s.read(key, meta)
+}
+
+// read reads the record of the key the meta points to from the datafiles of the snapshot.
+func (s *snapshot) read(key string, meta Meta) (Record, error) {
+	if s.closed.Load() {
+		return Record{}, ErrClosed
+	}
+	reader, ok := s.files[meta.fileId]
+	if !ok {
+		return Record{}, fmt.Errorf("error for looking for the key  in the file %d", meta.fileId)
+	}
+	return readRecord(reader, key, meta)
+}
+
+// readHeader reads only the header of the record the meta points to.
+func (s *snapshot) readHeader(meta Meta) (Header, error) {
+	var header Header
+	if s.closed.Load() {
+		return header, ErrClosed
+	}
+	reader, ok := s.files[meta.fileId]
+	if !ok {
+		return header, fmt.Errorf("error for looking for the key  in the file %d", meta.fileId)
+	}
+	data, err := reader.Read(meta.RecordPos-int64(meta.RecordSize)+headerSize, headerSize)
+	if err != nil {
+		return header, fmt.Errorf("Error reading header from database file: %v", err)
+	}
+	if err := header.Decode(data); err != nil {
+		return header, fmt.Errorf("Error decoding header: %v", err)
+	}
+	return header, nil
+}
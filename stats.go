@@ -0,0 +1,141 @@
+package bitcasgo
+
+import (
+	"sort"
+	"time"
+)
+
+// FileStats holds the accounting of live and dead data in a datafile.
+// Records are dead once they're overwritten, deleted or are tombstones themselves.
+type FileStats struct {
+	LiveBytes       int64
+	DeadBytes       int64
+	LiveKeys        int
+	DeadKeys        int
+	OldestTombstone time.Time // Zero if the datafile holds no tombstone
+}
+
+// Fragmentation returns the percentage of dead keys in the datafile.
+func (s FileStats) Fragmentation() float64 {
+	total := s.LiveKeys + s.DeadKeys
+	if total == 0 {
+		return 0
+	}
+	return float64(s.DeadKeys) * 100 / float64(total)
+}
+
+// FileStats returns the statistics of every datafile by id.
+func (b *BitCaspy) FileStats() map[int]FileStats {
+	b.RLock()
+	defer b.RUnlock()
+
+	stats := make(map[int]FileStats, len(b.stats))
+	for id, s := range b.stats {
+		stats[id] = *s
+	}
+	return stats
+}
+
+// fileStats returns the statistics of the datafile, creating them if needed.
+// The caller must hold the write lock, readers use statsOf.
+func (b *BitCaspy) fileStats(id int) *FileStats {
+	s, ok := b.stats[id]
+	if !ok {
+		s = &FileStats{}
+		b.stats[id] = s
+	}
+	return s
+}
+
+// statsOf returns a copy of the statistics of the datafile, zero if it has none yet.
+// Unlike fileStats it never changes the stats, so the read lock is enough.
+func (b *BitCaspy) statsOf(id int) FileStats {
+	if s, ok := b.stats[id]; ok {
+		return *s
+	}
+	return FileStats{}
+}
+
+// setKey points the key at a newly written record and accounts the record it
+// replaces as dead. The caller must hold the lock.
+func (b *BitCaspy) setKey(key string, meta Meta) {
+	if old, ok := b.KeyDir.Get(key); ok {
+		b.markDead(old)
+	}
+	s := b.fileStats(meta.fileId)
+	s.LiveBytes += int64(meta.RecordSize)
+	s.LiveKeys++
+	b.KeyDir.Put(key, meta)
+}
+
+// removeKey removes the key once its tombstone has been written, accounting
+// both the removed record and the tombstone as dead. The caller must hold the lock.
+func (b *BitCaspy) removeKey(key string, tombstone Meta) {
+	if old, ok := b.KeyDir.Get(key); ok {
+		b.markDead(old)
+		b.KeyDir.Delete(key)
+	}
+	b.addTombstone(tombstone)
+}
+
+// markDead moves a live record over to the dead data of its datafile.
+func (b *BitCaspy) markDead(meta Meta) {
+	s := b.fileStats(meta.fileId)
+	s.LiveBytes -= int64(meta.RecordSize)
+	s.LiveKeys--
+	s.DeadBytes += int64(meta.RecordSize)
+	s.DeadKeys++
+}
+
+// addDead accounts a record which was superseded before it became live as dead data.
+func (b *BitCaspy) addDead(meta Meta) {
+	s := b.fileStats(meta.fileId)
+	s.DeadBytes += int64(meta.RecordSize)
+	s.DeadKeys++
+}
+
+// addTombstone accounts a tombstone written to a datafile as dead data.
+func (b *BitCaspy) addTombstone(meta Meta) {
+	b.addDead(meta)
+	s := b.fileStats(meta.fileId)
+	if t := time.Unix(0, meta.tstamp); s.OldestTombstone.IsZero() || t.Before(s.OldestTombstone) {
+		s.OldestTombstone = t
+	}
+}
+
+// mergeCandidates returns the immutable datafiles which should be merged according to
+// the merge policy. Once any datafile crosses a merge trigger, every datafile crossing
+// a merge threshold is picked. The caller must hold at least the read lock.
+func (b *BitCaspy) mergeCandidates() []int {
+	triggered := false
+	for id := range b.stale {
+		s := b.statsOf(id)
+		if s.Fragmentation() >= b.opts.fragMergeTrigger || s.DeadBytes >= b.opts.deadBytesMergeTrigger {
+			triggered = true
+			break
+		}
+	}
+	if !triggered {
+		return nil
+	}
+
+	ids := make([]int, 0)
+	for id := range b.stale {
+		s := b.statsOf(id)
+		if s.Fragmentation() >= b.opts.fragThreshold || s.DeadBytes >= b.opts.deadBytesThreshold {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// inMergeWindow reports whether merges are allowed at the given time.
+func (o *Options) inMergeWindow(t time.Time) bool {
+	start, end, hour := o.mergeWindowStart, o.mergeWindowEnd, t.Hour()
+	if start <= end {
+		return hour >= start && hour < end
+	}
+	// The window wraps around midnight
+	return hour >= start || hour < end
+}
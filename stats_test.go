@@ -0,0 +1,55 @@
+package bitcasgo
+
+import "testing"
+
+func TestMergeCandidatesLeavesStatsAlone(t *testing.T) {
+	b, _ := openTest(t)
+	mustPut(t, b, "k", "v")
+	if err := b.RotateActiveFile(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A datafile without stats, such as one left holding only its preamble by a crash
+	b.Lock()
+	for id := range b.stale {
+		delete(b.stats, id)
+	}
+	b.Unlock()
+
+	b.RLock()
+	before := len(b.stats)
+	ids := b.mergeCandidates()
+	after := len(b.stats)
+	b.RUnlock()
+	if len(ids) != 0 {
+		t.Fatalf("mergeCandidates() = %v, want none", ids)
+	}
+	if after != before {
+		t.Fatalf("mergeCandidates changed the stats from %d to %d entries", before, after)
+	}
+}
+
+func TestStatsSurviveRestart(t *testing.T) {
+	b, dir := openTest(t)
+	mustPut(t, b, "a", "1", "a", "2", "a", "3", "b", "1", "c", "1")
+	if err := b.Delete("c"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.RotateActiveFile(); err != nil {
+		t.Fatal(err)
+	}
+	before := b.FileStats()
+	b.Close()
+
+	// The immutable datafile is loaded from its hint file
+	b = reopenTest(t, dir)
+	after := b.FileStats()
+	for id, want := range before {
+		if got := after[id]; got != want {
+			t.Errorf("stats of datafile %d = %+v after restart, want %+v", id, got, want)
+		}
+	}
+	if s := after[0]; s.DeadKeys != 4 || s.LiveKeys != 2 {
+		t.Errorf("stats of datafile 0 = %+v, want 4 dead and 2 live keys", s)
+	}
+}
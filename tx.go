@@ -0,0 +1,159 @@
+package bitcasgo
+
+// Tx is a transaction reading from a consistent snapshot of the database.
+// Writes are buffered and applied atomically as a batch when the transaction
+// commits. Commit fails with ErrConflict if any key read or written by the
+// transaction was changed by someone else since the snapshot was taken.
+// A Tx is not safe for concurrent use.
+type Tx struct {
+	b        *BitCaspy
+	snap     *snapshot
+	writable bool
+
+	reads  map[string]readEntry // keys read from the snapshot
+	writes map[string]batchOp   // latest pending write of every key
+	ops    []batchOp            // pending writes in order
+}
+
+// readEntry records what a transaction saw for a key in its snapshot.
+type readEntry struct {
+	meta  Meta
+	found bool
+}
+
+// View runs fn in a read only transaction.
+func (b *BitCaspy) View(fn func(tx *Tx) error) error {
+	tx, err := b.begin(false)
+	if err != nil {
+		return err
+	}
+	defer tx.discard()
+	return fn(tx)
+}
+
+// Update runs fn in a read-write transaction and commits it if fn returns nil.
+// The writes of the transaction are discarded if fn returns an error.
+func (b *BitCaspy) Update(fn func(tx *Tx) error) error {
+	if b.opts.readOnly {
+		return ErrReadOnly
+	}
+	tx, err := b.begin(true)
+	if err != nil {
+		return err
+	}
+	defer tx.discard()
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.commit()
+}
+
+func (b *BitCaspy) begin(writable bool) (*Tx, error) {
+	b.RLock()
+	defer b.RUnlock()
+	if b.closed.Load() {
+		return nil, ErrClosed
+	}
+	return &Tx{
+		b:        b,
+		snap:     b.newSnapshot(),
+		writable: writable,
+		reads:    make(map[string]readEntry),
+		writes:   make(map[string]batchOp),
+	}, nil
+}
+
+// Get returns the value of the key as seen by the transaction, including its own writes.
+func (tx *Tx) Get(key string) ([]byte, error) {
+	if op, ok := tx.writes[key]; ok {
+		if op.delete {
+			return nil, ErrNoKey
+		}
+		return op.value, nil
+	}
+
+	meta, found := tx.snap.keyDir.Get(key)
+	tx.reads[key] = readEntry{meta: meta, found: found}
+
+	record, err := tx.snap.get(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := record.validate(tx.b.opts.checksum); err != nil {
+		return nil, err
+	}
+	return tx.b.opts.decompressValue(record)
+}
+
+// Put queues the key and value to be written when the transaction commits.
+func (tx *Tx) Put(key string, value []byte) error {
+	if !tx.writable {
+		return ErrTxReadOnly
+	}
+	if err := validateEntry(key, value); err != nil {
+		return err
+	}
+	op := batchOp{key: key, value: value}
+	tx.writes[key] = op
+	tx.ops = append(tx.ops, op)
+	return nil
+}
+
+// Delete queues the deletion of the key when the transaction commits.
+func (tx *Tx) Delete(key string) error {
+	if !tx.writable {
+		return ErrTxReadOnly
+	}
+	if key == "" {
+		return ErrEmptyKey
+	}
+	op := batchOp{key: key, delete: true}
+	tx.writes[key] = op
+	tx.ops = append(tx.ops, op)
+	return nil
+}
+
+// commit validates that nothing the transaction depends on has changed since
+// its snapshot and writes the pending operations as a single batch.
+func (tx *Tx) commit() error {
+	if len(tx.ops) == 0 {
+		return nil
+	}
+
+	b := tx.b
+	b.Lock()
+	defer b.Unlock()
+	if b.closed.Load() {
+		return ErrClosed
+	}
+
+	for key, read := range tx.reads {
+		if tx.changed(key, read) {
+			return ErrConflict
+		}
+	}
+	for key := range tx.writes {
+		if _, ok := tx.reads[key]; ok {
+			continue
+		}
+		meta, found := tx.snap.keyDir.Get(key)
+		if tx.changed(key, readEntry{meta: meta, found: found}) {
+			return ErrConflict
+		}
+	}
+
+	return b.commitBatch(tx.ops)
+}
+
+// changed reports whether the key in the keydir differs from what the snapshot held.
+// Records are compared by their sequence number, a merge moves them to another
+// datafile without changing them. The caller must hold the lock.
+func (tx *Tx) changed(key string, seen readEntry) bool {
+	meta, found := tx.b.KeyDir.Get(key)
+	return found != seen.found || meta.seq != seen.meta.seq
+}
+
+func (tx *Tx) discard() {
+	tx.b.releaseSnapshot(tx.snap)
+	tx.ops = nil
+}
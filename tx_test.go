@@ -0,0 +1,47 @@
+package bitcasgo
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestTxConflict(t *testing.T) {
+	b, _ := openTest(t)
+	mustPut(t, b, "k", "v1")
+
+	err := b.Update(func(tx *Tx) error {
+		if _, err := tx.Get("k"); err != nil {
+			return err
+		}
+		mustPut(t, b, "k", "v2")
+		return tx.Put("k", []byte("v3"))
+	})
+	if !errors.Is(err, ErrConflict) {
+		t.Fatalf("Update error = %v, want ErrConflict", err)
+	}
+	assertGet(t, b, "k", "v2")
+}
+
+func TestTxMergeIsNoConflict(t *testing.T) {
+	b, _ := openTest(t)
+	mustPut(t, b, "k", "v1", "other", "x")
+	if err := b.RotateActiveFile(); err != nil {
+		t.Fatal(err)
+	}
+
+	err := b.Update(func(tx *Tx) error {
+		if _, err := tx.Get("k"); err != nil {
+			return err
+		}
+		// The merge moves k without changing it
+		if _, err := b.Merge(context.Background()); err != nil {
+			return err
+		}
+		return tx.Put("k", []byte("v2"))
+	})
+	if err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	assertGet(t, b, "k", "v2")
+}
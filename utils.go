@@ -7,6 +7,8 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+
+	datafile "bitcasgo/internal"
 )
 
 // Exists returns true if the given path exists on the filesystem.
@@ -34,7 +36,6 @@ func getDataFiles(outDir string) ([]string, error) {
 // Returns the list of sorted ids of the file
 func getIds(files []string) ([]int, error) {
 	ids := make([]int, 0)
-	fmt.Printf("Files: %v\n", files)
 	for _, file := range files {
 		id, err := strconv.ParseInt((strings.TrimPrefix(strings.TrimSuffix(filepath.Base(file), ".db"), "bitcaspy_")), 10, 32)
 		if err != nil {
@@ -45,3 +46,43 @@ func getIds(files []string) ([]int, error) {
 	sort.Ints(ids)
 	return ids, nil
 }
+
+// writeFileAtomic writes data to a temporary file, syncs it and renames it over path
+// so readers never observe a partially written file.
+func writeFileAtomic(path string, data []byte) error {
+	tmpPath := path + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// syncDir syncs the directory so that files created, renamed or removed in it survive a crash.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	if err := d.Sync(); err != nil {
+		d.Close()
+		return err
+	}
+	return d.Close()
+}
+
+// dataPath returns the path of the datafile with the given id.
+func (b *BitCaspy) dataPath(id int) string {
+	return filepath.Join(b.opts.dir, fmt.Sprintf(datafile.ACTIVE_DATAFILE, id))
+}